@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+// This annotation is added to a PV provisioned with nodeACL. Its value is the
+// aclState of the volume as JSON.
+const annACL = "iscsi-provisioner/acl"
+
+// Nodes carry the IQN of their initiator in this annotation. Labels cannot
+// hold IQNs, whose colons are not allowed in label values.
+const annInitiatorIQN = "iscsi-provisioner/initiator-iqn"
+
+// aclState records which initiators may log in to a volume provisioned with
+// nodeACL.
+type aclState struct {
+	// Selector of the nodes whose initiators may log in, empty for all
+	// nodes.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// Initiators from the initiators StorageClass parameter, allowed in
+	// addition to those of the nodes.
+	Initiators []string `json:"initiators,omitempty"`
+	// FollowPods is true if only the nodes running pods that use the claim
+	// of the volume may log in.
+	FollowPods bool `json:"followPods,omitempty"`
+	// Initiators currently allowed by the target.
+	Current []string `json:"current"`
+}
+
+// newACLState returns the aclState of a volume provisioned with the given
+// parameters for a claim with the given access modes. Pods are only followed
+// for ReadWriteOnce volumes, others may be used by several nodes at once.
+func newACLState(params *classParameters, accessModes []v1.PersistentVolumeAccessMode) *aclState {
+	return &aclState{
+		NodeSelector: params.nodeSelector,
+		Initiators:   params.initiators,
+		FollowPods:   params.podACL && len(accessModes) == 1 && accessModes[0] == v1.ReadWriteOnce,
+	}
+}
+
+// getACLState returns the aclState of a volume, nil if it has none.
+func getACLState(volume *v1.PersistentVolume) (*aclState, error) {
+	value, found := volume.Annotations[annACL]
+	if !found {
+		return nil, nil
+	}
+	acl := &aclState{}
+	if err := json.Unmarshal([]byte(value), acl); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation %q: %v", annACL, value, err)
+	}
+	return acl, nil
+}
+
+func setACLState(obj *v1.ObjectMeta, acl *aclState) error {
+	value, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	setAnnotation(obj, annACL, string(value))
+	return nil
+}
+
+// nodeInitiator returns the initiator IQN of a node, empty if it is unknown.
+func nodeInitiator(node *v1.Node) string {
+	return node.Annotations[annInitiatorIQN]
+}
+
+// watchNodes starts watching the nodes, and the pods if pods is true, unless
+// they are watched already, and returns true once they are listed. They are
+// only watched when provisioning or updating volumes with an ACL, so that
+// clusters without nodeACL classes don't cache all their pods.
+func (ctrl *iscsiController) watchNodes(pods bool) bool {
+	ctrl.nodeWatch.Do(func() {
+		glog.V(3).Infof("watching nodes for the initiator ACLs of volumes")
+		go ctrl.nodeController.Run(ctrl.stopCh)
+	})
+	if !pods {
+		return ctrl.nodeController.HasSynced()
+	}
+	ctrl.podWatch.Do(func() {
+		glog.V(3).Infof("watching pods for the initiator ACLs of volumes")
+		go ctrl.podController.Run(ctrl.stopCh)
+	})
+	return ctrl.nodeController.HasSynced() && ctrl.podController.HasSynced()
+}
+
+// desiredInitiators returns the sorted initiators that should be allowed to
+// log in to a volume with the given aclState, bound to the given claim.
+func (ctrl *iscsiController) desiredInitiators(acl *aclState, claimRef *v1.ObjectReference) ([]string, error) {
+	selector := labels.Everything()
+	if acl.NodeSelector != "" {
+		var err error
+		if selector, err = labels.Parse(acl.NodeSelector); err != nil {
+			return nil, fmt.Errorf("invalid node selector %q: %v", acl.NodeSelector, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var initiators []string
+	add := func(initiator string) {
+		if initiator != "" && !seen[initiator] {
+			seen[initiator] = true
+			initiators = append(initiators, initiator)
+		}
+	}
+	fenced := ctrl.fencedInitiators()
+	for _, initiator := range acl.Initiators {
+		if _, found := fenced[initiator]; !found {
+			add(initiator)
+		}
+	}
+	var podNodes map[string]bool
+	if acl.FollowPods {
+		podNodes = ctrl.claimNodes(claimRef)
+	}
+	for _, obj := range ctrl.nodes.List() {
+		node, ok := obj.(*v1.Node)
+		if !ok || !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		if acl.FollowPods && !podNodes[node.Name] {
+			continue
+		}
+		if ctrl.isFenced(node.Name) {
+			continue
+		}
+		initiator := nodeInitiator(node)
+		if initiator != "" && !isValidIQN(initiator) {
+			glog.V(3).Infof("ignoring invalid initiator %q of node %q", initiator, node.Name)
+			continue
+		}
+		add(initiator)
+	}
+	sort.Strings(initiators)
+	return initiators, nil
+}
+
+// shouldSyncACL returns true if the initiators allowed to log in to the given
+// volume provisioned by us differ from those of the matching nodes.
+func (ctrl *iscsiController) shouldSyncACL(volume *v1.PersistentVolume) bool {
+	if _, ok := ctrl.driver.(InitiatorManager); !ok {
+		return false
+	}
+	if volume.Annotations[annDynamicallyProvisioned] != ctrl.provisionerName ||
+		volume.Annotations[annExecMode] != ctrl.provisionerConfig.Opmode {
+		return false
+	}
+	acl, err := getACLState(volume)
+	if err != nil {
+		glog.V(3).Infof("error reading ACL of volume %q: %v", volume.Name, err)
+		return false
+	}
+	if acl == nil || !ctrl.watchNodes(acl.FollowPods) {
+		return false
+	}
+	initiators, err := ctrl.desiredInitiators(acl, volume.Spec.ClaimRef)
+	if err != nil {
+		glog.V(3).Infof("error computing ACL of volume %q: %v", volume.Name, err)
+		return false
+	}
+	return !equalStrings(initiators, acl.Current)
+}
+
+// syncACLOperation allows the initiators of the matching nodes to log in to
+// the target of a volume and records them in its annACL annotation.
+func (ctrl *iscsiController) syncACLOperation(volume *v1.PersistentVolume) {
+	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
+	if err != nil {
+		glog.V(3).Infof("error reading peristent volume %q: %v", volume.Name, err)
+		return
+	}
+	acl, err := getACLState(newVolume)
+	if err != nil || acl == nil {
+		return
+	}
+	initiators, err := ctrl.desiredInitiators(acl, newVolume.Spec.ClaimRef)
+	if err != nil || equalStrings(initiators, acl.Current) {
+		return
+	}
+
+	chap, err := ctrl.getChapCredentials(newVolume)
+	if err == nil {
+		err = ctrl.driver.(InitiatorManager).SetInitiators(newVolume, initiators, chap)
+	}
+	if err != nil {
+		glog.V(3).Infof("failed to update initiators of volume %q: %v", volume.Name, err)
+		ctrl.eventRecorder.Event(newVolume, v1.EventTypeWarning, "InitiatorACLFailed", err.Error())
+		return
+	}
+
+	for _, initiator := range acl.Current {
+		if node, found := ctrl.fencedInitiators()[initiator]; found && !containsString(initiators, initiator) {
+			ctrl.eventRecorder.Event(newVolume, v1.EventTypeWarning, "NodeFenced", fmt.Sprintf("Revoked access of fenced node %s with initiator %s", node, initiator))
+		}
+	}
+	acl.Current = initiators
+	if err := setACLState(&newVolume.ObjectMeta, acl); err != nil {
+		glog.Errorf("error encoding ACL of volume %q: %v", volume.Name, err)
+		return
+	}
+	if _, err := ctrl.client.Core().PersistentVolumes().Update(newVolume); err != nil {
+		glog.V(3).Infof("failed to update ACL of volume %q: %v", volume.Name, err)
+		return
+	}
+	glog.V(4).Infof("volume %q allows initiators %v", volume.Name, initiators)
+}
+
+// On add node, check the ACLs of all volumes.
+func (ctrl *iscsiController) addNode(obj interface{}) {
+	if node, ok := obj.(*v1.Node); ok {
+		ctrl.updateFencing(node)
+	}
+	ctrl.syncACLs()
+}
+
+// On update node, check the ACLs of all volumes if the labels, the initiator
+// or the fencing of the node changed. Updates occur at least every
+// resyncPeriod, which bounds how late nodes are fenced.
+func (ctrl *iscsiController) updateNode(oldObj, newObj interface{}) {
+	oldNode, ok := oldObj.(*v1.Node)
+	if !ok {
+		return
+	}
+	newNode, ok := newObj.(*v1.Node)
+	if !ok {
+		glog.Errorf("Expected Node but handler received %#v", newObj)
+		return
+	}
+	fencingChanged := ctrl.updateFencing(newNode)
+	if !fencingChanged && nodeInitiator(oldNode) == nodeInitiator(newNode) &&
+		labels.Set(oldNode.Labels).String() == labels.Set(newNode.Labels).String() {
+		return
+	}
+	ctrl.syncACLs()
+}
+
+// On delete node, forget its fencing and check the ACLs of all volumes.
+func (ctrl *iscsiController) deleteNode(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if node, ok := obj.(*v1.Node); ok {
+		ctrl.forgetFencing(node.Name)
+	}
+	ctrl.syncACLs()
+}
+
+// claimNodes returns the names of the nodes running pods that use the given
+// claim.
+func (ctrl *iscsiController) claimNodes(claimRef *v1.ObjectReference) map[string]bool {
+	nodes := make(map[string]bool)
+	if claimRef == nil {
+		return nodes
+	}
+	for _, obj := range ctrl.pods.List() {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.Namespace != claimRef.Namespace || !podRunsOnNode(pod) {
+			continue
+		}
+		for _, claimName := range podClaims(pod) {
+			if claimName == claimRef.Name {
+				nodes[pod.Spec.NodeName] = true
+			}
+		}
+	}
+	return nodes
+}
+
+// podRunsOnNode returns true if a pod is scheduled and has not terminated.
+// Pods being deleted keep their volumes until they are gone.
+func podRunsOnNode(pod *v1.Pod) bool {
+	return pod.Spec.NodeName != "" && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed
+}
+
+// podClaims returns the names of the claims used by a pod.
+func podClaims(pod *v1.Pod) []string {
+	var claims []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			claims = append(claims, volume.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	return claims
+}
+
+// On add or delete pod, check the ACLs of the volumes of its claims.
+func (ctrl *iscsiController) addPod(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		glog.Errorf("Expected Pod but handler received %#v", obj)
+		return
+	}
+	ctrl.syncPodACLs(pod)
+}
+
+// On update pod, check the ACLs of the volumes of its claims if it was
+// scheduled or terminated.
+func (ctrl *iscsiController) updatePod(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	newPod, ok := newObj.(*v1.Pod)
+	if !ok {
+		glog.Errorf("Expected Pod but handler received %#v", newObj)
+		return
+	}
+	if oldPod.Spec.NodeName == newPod.Spec.NodeName && podRunsOnNode(oldPod) == podRunsOnNode(newPod) {
+		return
+	}
+	ctrl.syncPodACLs(newPod)
+}
+
+func (ctrl *iscsiController) deletePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ctrl.addPod(obj)
+}
+
+// syncPodACLs schedules syncACLOperation for the volumes bound to the claims
+// of a pod whose ACL is out of date.
+func (ctrl *iscsiController) syncPodACLs(pod *v1.Pod) {
+	for _, claimName := range podClaims(pod) {
+		claimObj, found, err := ctrl.claims.GetByKey(pod.Namespace + "/" + claimName)
+		if err != nil || !found {
+			continue
+		}
+		claim, ok := claimObj.(*v1.PersistentVolumeClaim)
+		if !ok || claim.Spec.VolumeName == "" {
+			continue
+		}
+		volumeObj, found, err := ctrl.volumes.GetByKey(claim.Spec.VolumeName)
+		if err != nil || !found {
+			continue
+		}
+		volume, ok := volumeObj.(*v1.PersistentVolume)
+		if ok && ctrl.shouldSyncACL(volume) {
+			ctrl.scheduleACLSync(volume)
+		}
+	}
+}
+
+// syncACLs schedules syncACLOperation for all volumes whose ACL is out of
+// date.
+func (ctrl *iscsiController) syncACLs() {
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok || !ctrl.shouldSyncACL(volume) {
+			continue
+		}
+		ctrl.scheduleACLSync(volume)
+	}
+}
+
+func (ctrl *iscsiController) scheduleACLSync(volume *v1.PersistentVolume) {
+	opName := fmt.Sprintf("acl-%s[%s]", volume.Name, string(volume.UID))
+	ctrl.scheduleOperation(opName, func() error {
+		ctrl.syncACLOperation(volume)
+		return nil
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Volumes of classes with targetMode shared are exported as LUNs of targets
+// shared with other volumes instead of getting a target of their own: the
+// targets listed in the targetIQNs parameter, or targets of the class that
+// are added one after the other as the previous ones fill up. The controller
+// allocates a free target and LUN for each volume before it is provisioned
+// and records the allocation in the LUN inventory, a ConfigMap mapping PV
+// names to their target and LUN, so that a restarted provisioner never hands
+// out a LUN twice. The allocation is released when the volume is deleted.
+//
+// Who may log in to a target is configured for the whole target, so all
+// volumes of a target must have the same ACL settings. Each allocation
+// records those of its class and targets used with other settings are not
+// allocated from.
+
+// This annotation is added to a PV exported on a shared target. Its value is
+// the <target IQN>/<LUN> allocated for the volume.
+const annSharedTarget = "iscsi-provisioner/shared-target"
+
+// Highest LUN allocated unless the class has a lunRange.
+const defaultLastLun = 255
+
+// targetLun is a LUN of a target.
+type targetLun struct {
+	IQN string `json:"iqn"`
+	Lun int32  `json:"lun"`
+}
+
+func (t targetLun) String() string {
+	return fmt.Sprintf("%s/%d", t.IQN, t.Lun)
+}
+
+// lunAllocation is an entry of the LUN inventory.
+type lunAllocation struct {
+	targetLun
+	// ACL settings of the class of the volume, see classParameters.aclKey.
+	ACL string `json:"acl"`
+}
+
+// targetOccupancy describes the LUNs of a shared target in use once a LUN
+// was allocated on it.
+type targetOccupancy struct {
+	// Used is the number of LUNs of the target in use, including those
+	// outside the LUN range of the class.
+	Used int
+	// Free is the number of LUNs of the range of the class left free.
+	Free int
+}
+
+// splitConfigMapRef splits a ConfigMap reference given as namespace/name,
+// the namespace defaults to "default".
+func splitConfigMapRef(ref string) (string, string) {
+	if i := strings.Index(ref, "/"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return v1.NamespaceDefault, ref
+}
+
+// lunInventory returns the namespace and name of the LUN inventory.
+func (ctrl *iscsiController) lunInventory() (string, string) {
+	return splitConfigMapRef(ctrl.provisionerConfig.LunInventory)
+}
+
+// lunRange returns the LUNs volumes of a class are allocated from.
+func (ctrl *iscsiController) lunRange(params *classParameters) (int32, int32) {
+	if params.lastLun > 0 {
+		return params.firstLun, params.lastLun
+	}
+	return ctrl.driver.(TargetExporter).FirstLun(), defaultLastLun
+}
+
+// usedLuns returns the LUNs of the PVs in the cache.
+func (ctrl *iscsiController) usedLuns() map[targetLun]string {
+	used := make(map[targetLun]string)
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok || volume.Spec.ISCSI == nil {
+			continue
+		}
+		used[targetLun{IQN: volume.Spec.ISCSI.IQN, Lun: volume.Spec.ISCSI.Lun}] = volume.Name
+	}
+	return used
+}
+
+// pendingVolumeNames returns the names of the PVs of the known claims and
+// PVs, whose LUN allocations are in use or may still be.
+func (ctrl *iscsiController) pendingVolumeNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, obj := range ctrl.volumes.List() {
+		if volume, ok := obj.(*v1.PersistentVolume); ok {
+			names[volume.Name] = true
+		}
+	}
+	for _, obj := range ctrl.claims.List() {
+		if claim, ok := obj.(*v1.PersistentVolumeClaim); ok {
+			names[ctrl.getProvisionedVolumeNameForClaim(claim)] = true
+		}
+	}
+	return names
+}
+
+// sharedTargetPrefix returns the prefix of the IQNs of the shared targets
+// created for a class, which is followed by their index.
+func (ctrl *iscsiController) sharedTargetPrefix(class string) string {
+	return targetIQN(ctrl.provisionerConfig.TargetIQNPrefix, class+"-shared-")
+}
+
+// isSharedTarget returns true if volumes of the class with the given
+// parameters may be exported by the target with the given IQN.
+func (ctrl *iscsiController) isSharedTarget(iqn, class string, params *classParameters) bool {
+	if len(params.targetIQNs) > 0 {
+		return containsString(params.targetIQNs, iqn)
+	}
+	prefix := ctrl.sharedTargetPrefix(class)
+	if !strings.HasPrefix(iqn, prefix) {
+		return false
+	}
+	index, err := strconv.Atoi(iqn[len(prefix):])
+	return err == nil && index >= 0
+}
+
+// freeLun returns the first LUN between first and last of the target with
+// the given IQN that is not used.
+func freeLun(iqn string, first, last int32, used map[targetLun]string) (*targetLun, bool) {
+	for lun := first; lun <= last; lun++ {
+		candidate := targetLun{IQN: iqn, Lun: lun}
+		if _, found := used[candidate]; !found {
+			return &candidate, true
+		}
+	}
+	return nil, false
+}
+
+// allocateLun allocates a free LUN of the shared targets of a class for the
+// PV with the given name, or returns the one allocated for it before,
+// together with the occupancy of its target.
+func (ctrl *iscsiController) allocateLun(pvName, class string, params *classParameters) (*targetLun, *targetOccupancy, error) {
+	first, last := ctrl.lunRange(params)
+	used := ctrl.usedLuns()
+	pending := ctrl.pendingVolumeNames()
+
+	acl := params.aclKey()
+	var allocated *targetLun
+	// Targets allocated from.
+	var targets []string
+	// Targets whose volumes have other ACL settings.
+	conflicts := make(map[string]bool)
+	namespace, name := ctrl.lunInventory()
+	err := ctrl.updateConfigMap(namespace, name, func(data map[string]string) bool {
+		changed := false
+		acls := make(map[string]string)
+		for volumeName, value := range data {
+			allocation := lunAllocation{}
+			if err := json.Unmarshal([]byte(value), &allocation); err != nil {
+				glog.Errorf("ignoring invalid entry %q of LUN inventory %s/%s: %v", volumeName, namespace, name, err)
+				continue
+			}
+			if volumeName == pvName {
+				if ctrl.isSharedTarget(allocation.IQN, class, params) && allocation.Lun >= first && allocation.Lun <= last && allocation.ACL == acl {
+					allocated = &allocation.targetLun
+				}
+				continue
+			}
+			// Neither a PV nor a claim uses the allocation anymore,
+			// e.g. because the claim was deleted before its volume
+			// could be provisioned.
+			if !pending[volumeName] {
+				glog.V(3).Infof("releasing LUN %s of PV %q, which does not exist", allocation, volumeName)
+				delete(data, volumeName)
+				changed = true
+				continue
+			}
+			used[allocation.targetLun] = volumeName
+			if allocation.ACL != acl {
+				acls[allocation.IQN] = allocation.ACL
+			}
+		}
+		if allocated != nil {
+			return changed
+		}
+
+		targets = params.targetIQNs
+		if len(targets) == 0 {
+			// One of the first len(used)+1 targets of the class is
+			// empty.
+			prefix := ctrl.sharedTargetPrefix(class)
+			for i := 0; i <= len(used); i++ {
+				targets = append(targets, prefix+strconv.Itoa(i))
+			}
+		}
+		for _, iqn := range targets {
+			if _, found := acls[iqn]; found {
+				conflicts[iqn] = true
+				continue
+			}
+			candidate, found := freeLun(iqn, first, last, used)
+			if !found {
+				continue
+			}
+			value, err := json.Marshal(lunAllocation{targetLun: *candidate, ACL: acl})
+			if err != nil {
+				glog.Errorf("error encoding LUN %s: %v", candidate, err)
+				return changed
+			}
+			data[pvName] = string(value)
+			allocated = candidate
+			return true
+		}
+		return changed
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error updating LUN inventory %s/%s: %v", namespace, name, err)
+	}
+	if allocated == nil {
+		msg := fmt.Sprintf("no free LUN between %d and %d on targets %s", first, last, strings.Join(targets, ", "))
+		if len(conflicts) > 0 {
+			iqns := make([]string, 0, len(conflicts))
+			for iqn := range conflicts {
+				iqns = append(iqns, iqn)
+			}
+			sort.Strings(iqns)
+			msg += fmt.Sprintf(", targets %s export volumes with other ACL settings", strings.Join(iqns, ", "))
+		}
+		return nil, nil, fmt.Errorf("%s", msg)
+	}
+
+	occupancy := &targetOccupancy{Used: 1, Free: int(last - first)}
+	for lun := range used {
+		if lun.IQN != allocated.IQN || lun == *allocated {
+			continue
+		}
+		occupancy.Used++
+		if lun.Lun >= first && lun.Lun <= last {
+			occupancy.Free--
+		}
+	}
+	if occupancy.Used == 1 {
+		glog.V(2).Infof("exporting volume %q on new shared target %s", pvName, allocated.IQN)
+	}
+	glog.V(3).Infof("allocated LUN %s for volume %q, the target has %d LUNs in use and %d free", allocated, pvName, occupancy.Used, occupancy.Free)
+	return allocated, occupancy, nil
+}
+
+// releaseLun releases the LUN allocated for the PV with the given name, if it
+// has one.
+func (ctrl *iscsiController) releaseLun(pvName string) {
+	namespace, name := ctrl.lunInventory()
+	err := ctrl.updateConfigMap(namespace, name, func(data map[string]string) bool {
+		if _, found := data[pvName]; !found {
+			return false
+		}
+		delete(data, pvName)
+		return true
+	})
+	if err != nil {
+		// The allocation is dropped once it is found unused.
+		glog.Errorf("failed to release LUN of volume %q in LUN inventory %s/%s: %v", pvName, namespace, name, err)
+		return
+	}
+	glog.V(4).Infof("released LUN of volume %q", pvName)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Values of the chapAuth StorageClass parameter.
+const (
+	chapAuthNone   = "none"
+	chapAuthChap   = "chap"
+	chapAuthMutual = "mutual"
+)
+
+// Type and keys of the Secrets holding CHAP credentials, as read by the
+// iSCSI volume plugin of the nodes.
+const (
+	chapSecretType          = v1.SecretType("kubernetes.io/iscsi-chap")
+	chapSecretUsername      = "node.session.auth.username"
+	chapSecretPassword      = "node.session.auth.password"
+	chapSecretUsernameIn    = "node.session.auth.username_in"
+	chapSecretPasswordIn    = "node.session.auth.password_in"
+	chapSecretDiscoveryAuth = "discovery.sendtargets.auth.enabled"
+	chapSecretSessionAuth   = "node.session.auth.enabled"
+)
+
+// Length of generated CHAP passwords. Some initiators accept at most 16
+// characters.
+const chapPasswordLength = 16
+
+const chapPasswordCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// chapCredentials are the CHAP credentials of a volume.
+type chapCredentials struct {
+	// Credentials the initiator authenticates to the target with.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Credentials the target authenticates to the initiator with, empty
+	// unless mutual CHAP is used.
+	MutualUsername string `json:"mutualUsername,omitempty"`
+	MutualPassword string `json:"mutualPassword,omitempty"`
+}
+
+// newChapCredentials generates credentials for the given volume, with mutual
+// credentials if mutual is true.
+func newChapCredentials(pvName string, mutual bool) (*chapCredentials, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	chap := &chapCredentials{Username: pvName, Password: password}
+	if mutual {
+		if chap.MutualPassword, err = randomPassword(); err != nil {
+			return nil, err
+		}
+		chap.MutualUsername = pvName + "-target"
+	}
+	return chap, nil
+}
+
+// newChapSecret returns the Secret holding the given credentials.
+func newChapSecret(namespace, name string, chap *chapCredentials) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Type: chapSecretType,
+		Data: map[string][]byte{
+			chapSecretSessionAuth:   []byte("true"),
+			chapSecretDiscoveryAuth: []byte("false"),
+			chapSecretUsername:      []byte(chap.Username),
+			chapSecretPassword:      []byte(chap.Password),
+		},
+	}
+	if chap.MutualUsername != "" {
+		secret.Data[chapSecretUsernameIn] = []byte(chap.MutualUsername)
+		secret.Data[chapSecretPasswordIn] = []byte(chap.MutualPassword)
+	}
+	return secret
+}
+
+// chapFromSecret returns the credentials held by a Secret created by
+// newChapSecret.
+func chapFromSecret(secret *v1.Secret) (*chapCredentials, error) {
+	chap := &chapCredentials{
+		Username:       string(secret.Data[chapSecretUsername]),
+		Password:       string(secret.Data[chapSecretPassword]),
+		MutualUsername: string(secret.Data[chapSecretUsernameIn]),
+		MutualPassword: string(secret.Data[chapSecretPasswordIn]),
+	}
+	if chap.Username == "" || chap.Password == "" {
+		return nil, fmt.Errorf("secret %s/%s holds no CHAP credentials", secret.Namespace, secret.Name)
+	}
+	return chap, nil
+}
+
+// chapSecretName returns the name of the Secret holding the CHAP credentials
+// of the given volume.
+func chapSecretName(pvName string) string {
+	return fmt.Sprintf("%s-chap", pvName)
+}
+
+func randomPassword() (string, error) {
+	max := big.NewInt(int64(len(chapPasswordCharacters)))
+	password := make([]byte, chapPasswordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating CHAP password: %v", err)
+		}
+		password[i] = chapPasswordCharacters[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// These annotations can be set on a claim to provision its volume with a copy
+// of the data of a VolumeSnapshot or of another claim in its namespace. The
+// source must have the same StorageClass as the claim.
+const (
+	annCloneFromSnapshot = "iscsi-provisioner/clone-from-snapshot"
+	annCloneFromClaim    = "iscsi-provisioner/clone-from-claim"
+)
+
+// getCloneSource returns the source the volume of a claim of the given class
+// is cloned from, nil if it is provisioned empty. Errors that do not go away
+// on retry, e.g. a source of another class, are permanent.
+func (ctrl *iscsiController) getCloneSource(claim *v1.PersistentVolumeClaim, class string) (*CloneSource, error) {
+	snapshotName, fromSnapshot := claim.Annotations[annCloneFromSnapshot]
+	claimName, fromClaim := claim.Annotations[annCloneFromClaim]
+	if !fromSnapshot && !fromClaim {
+		return nil, nil
+	}
+	if fromSnapshot && fromClaim {
+		return nil, permanentError{fmt.Errorf("only one of the %s and %s annotations may be set", annCloneFromSnapshot, annCloneFromClaim)}
+	}
+	if _, restore := claim.Annotations[annRestoreFromTrash]; restore {
+		return nil, permanentError{fmt.Errorf("the %s annotation cannot be set together with %s or %s", annRestoreFromTrash, annCloneFromSnapshot, annCloneFromClaim)}
+	}
+	if _, ok := ctrl.driver.(Cloner); !ok {
+		return nil, permanentError{fmt.Errorf("cloning is not supported in %s execmode", ctrl.provisionerConfig.Opmode)}
+	}
+	if fromClaim {
+		return ctrl.claimCloneSource(claim, claimName, class)
+	}
+	return ctrl.snapshotCloneSource(claim, snapshotName, class)
+}
+
+// claimCloneSource returns the volume bound to the named claim in the
+// namespace of the given claim.
+func (ctrl *iscsiController) claimCloneSource(claim *v1.PersistentVolumeClaim, name, class string) (*CloneSource, error) {
+	if name == claim.Name {
+		return nil, permanentError{fmt.Errorf("claim %s cannot be cloned from itself", claimToClaimKey(claim))}
+	}
+	sourceClaim, err := ctrl.client.Core().PersistentVolumeClaims(claim.Namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source claim %s/%s: %v", claim.Namespace, name, err)
+	}
+	if sourceClaim.Spec.VolumeName == "" || sourceClaim.Status.Phase != v1.ClaimBound {
+		return nil, fmt.Errorf("source claim %s is not bound yet", claimToClaimKey(sourceClaim))
+	}
+	volume, err := ctrl.client.Core().PersistentVolumes().Get(sourceClaim.Spec.VolumeName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading volume %q of source claim %s: %v", sourceClaim.Spec.VolumeName, claimToClaimKey(sourceClaim), err)
+	}
+	if volume.Annotations[annDynamicallyProvisioned] != ctrl.provisionerName ||
+		volume.Annotations[annExecMode] != ctrl.provisionerConfig.Opmode {
+		return nil, permanentError{fmt.Errorf("volume %q of source claim %s was not provisioned by %s in %s execmode", volume.Name, claimToClaimKey(sourceClaim), ctrl.provisionerName, ctrl.provisionerConfig.Opmode)}
+	}
+	if sourceClass := volume.Annotations[annClass]; sourceClass != class {
+		return nil, permanentError{fmt.Errorf("source claim %s has StorageClass %q, not %q", claimToClaimKey(sourceClaim), sourceClass, class)}
+	}
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	return &CloneSource{
+		BackendID: getBackendID(volume),
+		SizeBytes: capacity.Value(),
+	}, nil
+}
+
+// snapshotCloneSource returns the named VolumeSnapshot in the namespace of
+// the given claim.
+func (ctrl *iscsiController) snapshotCloneSource(claim *v1.PersistentVolumeClaim, name, class string) (*CloneSource, error) {
+	if ctrl.snapshotController == nil {
+		return nil, permanentError{fmt.Errorf("snapshots are not supported in %s execmode", ctrl.provisionerConfig.Opmode)}
+	}
+	obj, err := ctrl.snapshots(claim.Namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading source %s %s/%s: %v", snapshotKind, claim.Namespace, name, err)
+	}
+	snapshot, err := decodeSnapshot(obj)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	if snapshot.Status.Error != "" {
+		return nil, permanentError{fmt.Errorf("source %s %s/%s failed: %s", snapshotKind, claim.Namespace, name, snapshot.Status.Error)}
+	}
+	if !snapshot.Status.Ready {
+		return nil, fmt.Errorf("source %s %s/%s is not ready yet", snapshotKind, claim.Namespace, name)
+	}
+	if snapshot.Status.ExecMode != ctrl.provisionerConfig.Opmode {
+		return nil, permanentError{fmt.Errorf("source %s %s/%s was not taken in %s execmode", snapshotKind, claim.Namespace, name, ctrl.provisionerConfig.Opmode)}
+	}
+	if sourceClass := snapshot.Status.StorageClass; sourceClass != class {
+		return nil, permanentError{fmt.Errorf("source %s %s/%s was taken of a volume with StorageClass %q, not %q", snapshotKind, claim.Namespace, name, sourceClass, class)}
+	}
+	return &CloneSource{
+		SnapshotID: snapshot.Status.SnapshotID,
+		SizeBytes:  snapshot.Status.SizeBytes,
+	}, nil
+}
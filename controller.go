@@ -2,20 +2,23 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
+	"strconv"
 	"time"
 	"strings"
-	"bytes"
+	"sync"
 	"github.com/golang/glog"
 	"github.com/humblec/iscsi-provisioner/framework"
+	"k8s.io/client-go/1.4/dynamic"
 	"k8s.io/client-go/1.4/kubernetes"
 	core_v1 "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
 	"k8s.io/client-go/1.4/pkg/api"
+	apierrs "k8s.io/client-go/1.4/pkg/api/errors"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
 	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/util/wait"
 	"k8s.io/client-go/1.4/pkg/watch"
 	"k8s.io/client-go/1.4/tools/cache"
 	"k8s.io/client-go/1.4/tools/record"
@@ -43,12 +46,43 @@ const annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
 // https://github.com/kubernetes/kubernetes/pull/30285
 const annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
 
+// This annotation is added to a PV provisioned by this provisioner. Its value
+// is the execmode whose driver created the storage asset; only that driver is
+// asked to delete it.
+const annExecMode = "iscsi-provisioner/execmode"
+
+// This annotation is added to a PV provisioned by this provisioner when its
+// driver reported how the storage asset is identified on the backend.
+const annBackendID = "iscsi-provisioner/backend-id"
+
+// An admin sets this annotation to "true" on a released PV with the Retain
+// reclaim policy to have its storage deleted like that of a PV with the Delete
+// policy.
+const annDeleteRetained = "iscsi-provisioner/delete-retained"
+
+// This annotation is kept up to date on PVs whose driver reports how much
+// backend storage they really occupy. Its value is a number of bytes.
+const annAllocatedBytes = "iscsi-provisioner/allocated-bytes"
+
+// This annotation is added to a PV whose target can be reached at more than
+// one portal. Its value are the portals other than the TargetPortal of the PV,
+// separated by commas, for node tooling setting up multipath.
+const annAlternatePortals = "iscsi-provisioner/alternate-portals"
+
+// This annotation is added to a PV whose target requires CHAP authentication.
+// Its value is the <namespace>/<name> of the Secret holding the credentials.
+// TODO: use ISCSIVolumeSource.SecretRef once the API has it.
+const annChapSecret = "iscsi-provisioner/chap-secret"
+
 // Number of retries when we create a PV object for a provisioned volume.
 const createProvisionedPVRetryCount = 5
 
 // Interval between retries when we create a PV object for a provisioned volume.
 const createProvisionedPVInterval = 10 * time.Second
 
+// Number of retries when a ConfigMap is updated concurrently.
+const configMapRetryCount = 5
+
 type iscsiController struct {
 	client kubernetes.Interface
 
@@ -57,6 +91,8 @@ type iscsiController struct {
 	// annStorageProvisioner to set & watch for, respectively
 	provisionerName string
 	provisionerConfig ProvisionerConfig
+	// Driver of the configured execmode, creates and deletes volumes.
+	driver Driver
 
 	claimSource      cache.ListerWatcher
 	claimController  *framework.Controller
@@ -64,16 +100,48 @@ type iscsiController struct {
 	volumeController *framework.Controller
 	classSource      cache.ListerWatcher
 	classReflector   *cache.Reflector
+	// Nodes and pods are only watched once a volume or a class needs
+	// them for its ACL, see watchNodes.
+	nodeSource     cache.ListerWatcher
+	nodeController *framework.Controller
+	nodeWatch      sync.Once
+	podSource      cache.ListerWatcher
+	podController  *framework.Controller
+	podWatch       sync.Once
+	stopCh         <-chan struct{}
+	// VolumeSnapshot objects are only watched if the driver is a
+	// Snapshotter.
+	snapshotClient     *dynamic.Client
+	snapshotSource     cache.ListerWatcher
+	snapshotController *framework.Controller
+	snapshotStore      cache.Store
 
 	volumes cache.Store
 	claims  cache.Store
 	classes cache.Store
+	nodes   cache.Store
+	pods    cache.Store
 
 	eventRecorder record.EventRecorder
 
 	// Map of scheduled/running operations.
 	runningOperations goroutinemap.GoRoutineMap
 
+	// Claims whose provisioning failed permanently and that are not
+	// retried, by claim UID.
+	failedClaims     map[string]claimFailure
+	failedClaimsLock sync.Mutex
+	// Expansions of claims that failed permanently, by claim UID.
+	failedExpansions map[string]expansionFailure
+
+	// Initiator IQNs of the nodes fenced for being NotReady longer than
+	// the fencing grace period, by node name.
+	fencedNodes     map[string]string
+	fencedNodesLock sync.Mutex
+
+	// Serializes updates of the ConfigMaps of the provisioner.
+	configMapsLock sync.Mutex
+
 	createProvisionedPVRetryCount int
 	createProvisionedPVInterval   time.Duration
 }
@@ -83,6 +151,8 @@ func newiscsiController(
 	resyncPeriod time.Duration,
 	provisionerName string,
 	provisionerConfig ProvisionerConfig,
+	driver Driver,
+	snapshotClient *dynamic.Client,
 ) *iscsiController {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
@@ -99,8 +169,13 @@ func newiscsiController(
 		client:                        client,
 		provisionerName:               provisionerName,
 		provisionerConfig: 				provisionerConfig,
+		driver:                        driver,
+		snapshotClient:                snapshotClient,
 		eventRecorder:                 eventRecorder,
 		runningOperations:             goroutinemap.NewGoRoutineMap(false /* exponentialBackOffOnError */),
+		failedClaims:                  make(map[string]claimFailure),
+		failedExpansions:              make(map[string]expansionFailure),
+		fencedNodes:                   make(map[string]string),
 		createProvisionedPVRetryCount: createProvisionedPVRetryCount,
 		createProvisionedPVInterval:   createProvisionedPVInterval,
 	}
@@ -120,7 +195,7 @@ func newiscsiController(
 		framework.ResourceEventHandlerFuncs{
 			AddFunc:    controller.addClaim,
 			UpdateFunc: controller.updateClaim,
-			DeleteFunc: nil,
+			DeleteFunc: controller.deleteClaim,
 		},
 	)
 
@@ -161,19 +236,83 @@ func newiscsiController(
 		resyncPeriod,
 	)
 
+	controller.nodeSource = &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return client.Core().Nodes().List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return client.Core().Nodes().Watch(options)
+		},
+	}
+	controller.nodes, controller.nodeController = framework.NewInformer(
+		controller.nodeSource,
+		&v1.Node{},
+		resyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    controller.addNode,
+			UpdateFunc: controller.updateNode,
+			DeleteFunc: controller.deleteNode,
+		},
+	)
+
+	controller.podSource = &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return client.Core().Pods(v1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return client.Core().Pods(v1.NamespaceAll).Watch(options)
+		},
+	}
+	controller.pods, controller.podController = framework.NewInformer(
+		controller.podSource,
+		&v1.Pod{},
+		resyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    controller.addPod,
+			UpdateFunc: controller.updatePod,
+			DeleteFunc: controller.deletePod,
+		},
+	)
+
+	if _, ok := driver.(Snapshotter); ok && snapshotClient != nil {
+		controller.snapshotSource = controller.newSnapshotSource()
+		controller.snapshotStore, controller.snapshotController = framework.NewInformer(
+			controller.snapshotSource,
+			&runtime.Unstructured{},
+			resyncPeriod,
+			framework.ResourceEventHandlerFuncs{
+				AddFunc:    controller.addSnapshot,
+				UpdateFunc: controller.updateSnapshot,
+				DeleteFunc: controller.deleteSnapshot,
+			},
+		)
+	}
+
 	return controller
 }
 
 func (ctrl *iscsiController) Run(stopCh <-chan struct{}) {
 	glog.Info("Starting iscsi provisioner controller!")
+	ctrl.stopCh = stopCh
 	go ctrl.claimController.Run(stopCh)
 	go ctrl.volumeController.Run(stopCh)
 	go ctrl.classReflector.RunUntil(stopCh)
+	if _, ok := ctrl.driver.(Trasher); ok {
+		go wait.Until(ctrl.purgeTrash, trashPurgeInterval, stopCh)
+	}
+	if ctrl.snapshotController != nil {
+		if err := ensureSnapshotResource(ctrl.client); err != nil {
+			glog.Errorf("Failed to register the %s resource, snapshots are disabled: %v", snapshotKind, err)
+		} else {
+			go ctrl.snapshotController.Run(stopCh)
+			go wait.Until(ctrl.sweepSnapshots, snapshotSweepInterval, stopCh)
+		}
+	}
 	<-stopCh
 }
 
 // On add claim, check if the added claim should have a volume provisioned for
-// it and provision one if so.
+// it and provision one if so, or if its volume should be expanded.
 func (ctrl *iscsiController) addClaim(obj interface{}) {
 	claim, ok := obj.(*v1.PersistentVolumeClaim)
 	if !ok {
@@ -183,10 +322,19 @@ func (ctrl *iscsiController) addClaim(obj interface{}) {
 
 	if ctrl.shouldProvision(claim) {
 		opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
+		if pvName, found := claim.Annotations[annRestoreFromTrash]; found {
+			// Don't restore a trashed volume while it is purged.
+			opName = trashOperationName(pvName)
+		}
 		ctrl.scheduleOperation(opName, func() error {
 			ctrl.provisionClaimOperation(claim)
 			return nil
 		})
+	} else if volume := ctrl.shouldExpand(claim); volume != nil {
+		ctrl.scheduleOperation(volumeOperationName(volume), func() error {
+			ctrl.expandVolumeOperation(claim, volume)
+			return nil
+		})
 	}
 }
 
@@ -196,8 +344,25 @@ func (ctrl *iscsiController) updateClaim(oldObj, newObj interface{}) {
 	ctrl.addClaim(newObj)
 }
 
+// On delete claim, forget its failed operations.
+func (ctrl *iscsiController) deleteClaim(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		glog.Errorf("Expected PersistentVolumeClaim but deleteClaim received %+v", obj)
+		return
+	}
+	ctrl.failedClaimsLock.Lock()
+	defer ctrl.failedClaimsLock.Unlock()
+	delete(ctrl.failedClaims, string(claim.UID))
+	delete(ctrl.failedExpansions, string(claim.UID))
+}
+
 // On update volume, check if the updated volume should be deleted and delete if
-// so. Updates occur at least every resyncPeriod.
+// so, or bring its usage and ACL up to date otherwise. Updates occur at least
+// every resyncPeriod.
 func (ctrl *iscsiController) updateVolume(oldObj, newObj interface{}) {
 	volume, ok := newObj.(*v1.PersistentVolume)
 	if !ok {
@@ -206,11 +371,21 @@ func (ctrl *iscsiController) updateVolume(oldObj, newObj interface{}) {
 	}
 
 	if ctrl.shouldDelete(volume) {
-		opName := fmt.Sprintf("delete-%s[%s]", volume.Name, string(volume.UID))
-		ctrl.scheduleOperation(opName, func() error {
+		ctrl.scheduleOperation(volumeOperationName(volume), func() error {
 			ctrl.deleteVolumeOperation(volume)
 			return nil
 		})
+		return
+	}
+	if ctrl.shouldUpdateUsage(volume) {
+		opName := fmt.Sprintf("usage-%s[%s]", volume.Name, string(volume.UID))
+		ctrl.scheduleOperation(opName, func() error {
+			ctrl.updateUsageOperation(volume)
+			return nil
+		})
+	}
+	if ctrl.shouldSyncACL(volume) {
+		ctrl.scheduleACLSync(volume)
 	}
 }
 
@@ -225,6 +400,14 @@ func (ctrl *iscsiController) shouldProvision(claim *v1.PersistentVolumeClaim) bo
 		return false
 	}
 
+	failure := claimFailure{claimVersion: claim.ResourceVersion, classVersion: ctrl.classVersion(getClaimClass(claim))}
+	ctrl.failedClaimsLock.Lock()
+	failed := ctrl.failedClaims[string(claim.UID)] == failure
+	ctrl.failedClaimsLock.Unlock()
+	if failed {
+		return false
+	}
+
 	claimClass := getClaimClass(claim)
 	classObj, found, err := ctrl.classes.GetByKey(claimClass)
 	if err != nil {
@@ -254,20 +437,90 @@ func (ctrl *iscsiController) shouldDelete(volume *v1.PersistentVolume) bool {
 		return false
 	}
 
-	if hasAnnotation(volume.ObjectMeta, annDynamicallyProvisioned) {
-		if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+	// Retained volumes are only deleted when an admin asks for it.
+	switch volume.Spec.PersistentVolumeReclaimPolicy {
+	case v1.PersistentVolumeReclaimDelete:
+	case v1.PersistentVolumeReclaimRetain:
+		if volume.Status.Phase != v1.VolumeReleased || !deleteRetainedRequested(volume) {
 			return false
 		}
+	default:
+		return false
 	}
 
-	path := fmt.Sprintf("iscsi-volume-%s", volume.ObjectMeta.Name)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+		return false
+	}
+
+	// Volumes that could not be wiped are kept until an admin intervenes.
+	if hasAnnotation(volume.ObjectMeta, annWipeFailed) {
+		return false
+	}
+
+	// Volumes created by another driver, or before the driver was recorded,
+	// cannot be deleted by ours.
+	if ann := volume.Annotations[annExecMode]; ann != ctrl.provisionerConfig.Opmode {
 		return false
 	}
 
 	return true
 }
 
+// shouldUpdateUsage returns true if the driver can report the allocation of
+// the given bound volume provisioned by it.
+func (ctrl *iscsiController) shouldUpdateUsage(volume *v1.PersistentVolume) bool {
+	if _, ok := ctrl.driver.(UsageReporter); !ok {
+		return false
+	}
+	if volume.Status.Phase != v1.VolumeBound {
+		return false
+	}
+	return volume.Annotations[annDynamicallyProvisioned] == ctrl.provisionerName &&
+		volume.Annotations[annExecMode] == ctrl.provisionerConfig.Opmode
+}
+
+// updateUsageOperation records the backend storage allocated to a volume in
+// its annAllocatedBytes annotation. The PV is only updated when the value
+// changes, starting from the latest version in the cache.
+func (ctrl *iscsiController) updateUsageOperation(volume *v1.PersistentVolume) {
+	usage, err := ctrl.driver.(UsageReporter).Usage(volume)
+	if err != nil {
+		glog.V(3).Infof("error getting usage of volume %q: %v", volume.Name, err)
+		return
+	}
+	if usage < 0 {
+		return
+	}
+	allocated := strconv.FormatInt(usage, 10)
+
+	// The PV may have changed since the operation was scheduled.
+	obj, found, err := ctrl.volumes.GetByKey(volume.Name)
+	if err != nil || !found {
+		glog.V(3).Infof("persistent volume %q not found in the cache: %v", volume.Name, err)
+		return
+	}
+	cached, ok := obj.(*v1.PersistentVolume)
+	if !ok || cached.UID != volume.UID {
+		return
+	}
+	if cached.Annotations[annAllocatedBytes] == allocated {
+		return
+	}
+	copied, err := api.Scheme.Copy(cached)
+	if err != nil {
+		glog.Errorf("error copying persistent volume %q: %v", volume.Name, err)
+		return
+	}
+	newVolume := copied.(*v1.PersistentVolume)
+	setAnnotation(&newVolume.ObjectMeta, annAllocatedBytes, allocated)
+	// Conflicting updates are retried at the next resync.
+	if _, err := ctrl.client.Core().PersistentVolumes().Update(newVolume); err != nil {
+		glog.V(3).Infof("failed to update usage of volume %q: %v", volume.Name, err)
+		return
+	}
+	glog.V(4).Infof("volume %q has %s bytes allocated", volume.Name, allocated)
+}
+
 func (ctrl *iscsiController) provisionClaimOperation(claim *v1.PersistentVolumeClaim) {
 	// Most code here is identical to that found in controller.go of kube's PV controller...
 	claimClass := getClaimClass(claim)
@@ -307,18 +560,176 @@ func (ctrl *iscsiController) provisionClaimOperation(claim *v1.PersistentVolumeC
 		return
 	}
 
+	params, driverParameters, err := parseClassParameters(storageClass.Parameters)
+	if err == nil {
+		if _, ok := ctrl.driver.(InitiatorManager); params.nodeACL && !ok {
+			err = fmt.Errorf("%s is not supported in %s execmode", paramNodeACL, ctrl.provisionerConfig.Opmode)
+		}
+	}
+	if err == nil {
+		err = ctrl.checkWipePolicy(params.wipePolicy)
+	}
+	if err == nil {
+		if _, ok := ctrl.driver.(Trasher); params.trashRetention > 0 && !ok {
+			err = fmt.Errorf("%s is not supported in %s execmode", paramTrashRetention, ctrl.provisionerConfig.Opmode)
+		}
+	}
+	if err == nil && params.sharedTargets() {
+		if exporter, ok := ctrl.driver.(TargetExporter); !ok {
+			err = fmt.Errorf("%s %s is not supported in %s execmode", paramTargetMode, targetModeShared, ctrl.provisionerConfig.Opmode)
+		} else if params.lastLun > 0 && params.firstLun < exporter.FirstLun() {
+			err = fmt.Errorf("%s must not start below LUN %d", paramLunRange, exporter.FirstLun())
+		}
+	}
+	if err == nil {
+		if validator, ok := ctrl.driver.(ParameterValidator); ok {
+			err = validator.ValidateParameters(driverParameters)
+		}
+	}
+	if err != nil {
+		// StorageClass parameters cannot change, don't retry.
+		strerr := fmt.Sprintf("Invalid parameters of StorageClass %q: %v", storageClass.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q: %s", claimToClaimKey(claim), strerr)
+		ctrl.setClaimFailed(claim)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return
+	}
+	if err = params.checkAccessModes(claim.Spec.AccessModes); err != nil {
+		// Neither can the access modes of the claim.
+		strerr := fmt.Sprintf("Cannot provision volume with StorageClass %q: %v", storageClass.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q: %s", claimToClaimKey(claim), strerr)
+		ctrl.setClaimFailed(claim)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return
+	}
+
+	// The volume is created empty, cloned or restored from the trash.
+	create := ctrl.driver.Provision
+	cleanup := ctrl.delete
+	var sourceSize int64
+	source, err := ctrl.getCloneSource(claim, claimClass)
+	var trashed *trashEntry
+	if err == nil && source == nil {
+		trashed, err = ctrl.getTrashedVolume(claim, claimClass)
+	}
+	if err != nil {
+		strerr := fmt.Sprintf("Cannot provision volume from its source: %v", err)
+		glog.Errorf("Failed to provision volume for claim %q: %s", claimToClaimKey(claim), strerr)
+		if !isTemporary(err) {
+			ctrl.setClaimFailed(claim)
+		}
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return
+	}
+	if source != nil {
+		sourceSize = source.SizeBytes
+		create = func(options VolumeOptions) (*Volume, error) {
+			return ctrl.driver.(Cloner).Clone(options, source)
+		}
+	}
+	if trashed != nil {
+		sourceSize = trashed.SizeBytes
+		create = func(options VolumeOptions) (*Volume, error) {
+			return ctrl.driver.(Trasher).Restore(trashed.ID, options)
+		}
+		// Never delete restored data, put it back instead.
+		cleanup = func(volume *v1.PersistentVolume) error {
+			return ctrl.retrashVolume(claim.Annotations[annRestoreFromTrash], trashed, volume)
+		}
+	}
+
+	requested := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	size := requested.Value()
+	if size < params.minSize {
+		size = params.minSize
+	}
+	if rounder, ok := ctrl.driver.(SizeRounder); ok {
+		if size, err = rounder.RoundSize(size, driverParameters); err != nil {
+			glog.Errorf("Failed to provision volume for claim %q: %v", claimToClaimKey(claim), err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			return
+		}
+	}
+	// Rounding may grow the volume beyond maxSize.
+	if params.maxSize > 0 && size > params.maxSize {
+		strerr := fmt.Sprintf("Cannot provision volume with StorageClass %q: requested size %s, %d bytes once rounded, exceeds %s %d bytes", storageClass.Name, requested.String(), size, paramMaxSize, params.maxSize)
+		glog.Errorf("Failed to provision volume for claim %q: %s", claimToClaimKey(claim), strerr)
+		ctrl.setClaimFailed(claim)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return
+	}
+	// Compare the size the volume really gets, rounding may make it large
+	// enough for the source.
+	if size < sourceSize {
+		strerr := fmt.Sprintf("Cannot provision volume from its source: requested size %s, %d bytes once rounded, is smaller than the %d bytes of the source", requested.String(), size, sourceSize)
+		glog.Errorf("Failed to provision volume for claim %q: %s", claimToClaimKey(claim), strerr)
+		ctrl.setClaimFailed(claim)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return
+	}
+
 	options := VolumeOptions{
-		Capacity:                      claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+		Capacity:                      *resource.NewQuantity(size, resource.BinarySI),
 		AccessModes:                   claim.Spec.AccessModes,
-		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PersistentVolumeReclaimPolicy: params.reclaimPolicy,
 		PVName:     pvName,
+		PVC:        claim,
+		Initiators: params.initiators,
+		ACL:        params.acl(),
 		Parameters: storageClass.Parameters,
 	}
+	if params.nodeACL {
+		// Wait for the nodes to be known rather than lock them out.
+		if !ctrl.watchNodes(params.podACL) {
+			glog.V(4).Infof("provisionClaimOperation [%s]: nodes not listed yet, retrying later", claimToClaimKey(claim))
+			return
+		}
+		options.Initiators, err = ctrl.desiredInitiators(newACLState(params, claim.Spec.AccessModes), claimRef)
+		if err != nil {
+			glog.Errorf("Failed to provision volume for claim %q: %v", claimToClaimKey(claim), err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			return
+		}
+	}
+	if params.chapAuth != chapAuthNone {
+		if options.Chap, err = ctrl.claimChapCredentials(claim.Namespace, pvName, params.chapAuth == chapAuthMutual); err != nil {
+			glog.Errorf("Failed to provision volume for claim %q: %v", claimToClaimKey(claim), err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			return
+		}
+	}
 
-	volume, err = ctrl.provision(options)
+	if params.sharedTargets() {
+		// Allocations of volumes and claims not listed yet look unused.
+		if !ctrl.volumeController.HasSynced() || !ctrl.claimController.HasSynced() {
+			glog.V(4).Infof("provisionClaimOperation [%s]: volumes not listed yet, retrying later", claimToClaimKey(claim))
+			return
+		}
+		var occupancy *targetOccupancy
+		if options.Target, occupancy, err = ctrl.allocateLun(pvName, claimClass, params); err != nil {
+			glog.Errorf("Failed to provision volume for claim %q: %v", claimToClaimKey(claim), err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", err.Error())
+			return
+		}
+		ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "LunAllocated", fmt.Sprintf("Allocated LUN %d of shared target %s, which has %d LUNs in use and %d free", options.Target.Lun, options.Target.IQN, occupancy.Used, occupancy.Free))
+	}
+
+	volume, err = ctrl.provision(options, params, create)
 	if err != nil {
 		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
 		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), claim.Name, err)
+		if !isTemporary(err) {
+			strerr += ", not retrying"
+			ctrl.setClaimFailed(claim)
+			if options.Target != nil {
+				ctrl.releaseLun(pvName)
+			}
+			if options.Chap != nil {
+				if err := ctrl.deleteSecret(claim.Namespace, chapSecretName(pvName)); err != nil {
+					glog.Errorf("Failed to clean up after claim %q: %v", claimToClaimKey(claim), err)
+				}
+			}
+		}
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
 		return
 	}
@@ -330,6 +741,12 @@ func (ctrl *iscsiController) provisionClaimOperation(claim *v1.PersistentVolumeC
 
 	setAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, ctrl.provisionerName)
 	setAnnotation(&volume.ObjectMeta, annClass, claimClass)
+	if params.trashRetention > 0 {
+		setAnnotation(&volume.ObjectMeta, annTrashRetention, params.trashRetention.String())
+	}
+	if params.wipePolicy != wipePolicyNone {
+		setAnnotation(&volume.ObjectMeta, annWipePolicy, params.wipePolicy)
+	}
 
 	// Try to create the PV object several times
 	for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
@@ -354,9 +771,12 @@ func (ctrl *iscsiController) provisionClaimOperation(claim *v1.PersistentVolumeC
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
 
 		for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
-			if err = ctrl.delete(volume); err == nil {
+			if err = cleanup(volume); err == nil {
 				// Delete succeeded
 				glog.V(4).Infof("provisionClaimOperation [%s]: cleaning volume %s succeeded", claimToClaimKey(claim), volume.Name)
+				if options.Target != nil {
+					ctrl.releaseLun(pvName)
+				}
 				break
 			}
 			// Delete failed, try again after a while.
@@ -373,6 +793,9 @@ func (ctrl *iscsiController) provisionClaimOperation(claim *v1.PersistentVolumeC
 		}
 	} else {
 		glog.V(2).Infof("volume %q provisioned for claim %q", volume.Name, claimToClaimKey(claim))
+		if trashed != nil {
+			ctrl.restoredVolume(claim.Annotations[annRestoreFromTrash], trashed, claim)
+		}
 	}
 }
 
@@ -387,67 +810,126 @@ type VolumeOptions struct {
 	// PV.Name of the appropriate PersistentVolume. Used to generate cloud
 	// volume name.
 	PVName string
+	// PVC is the claim the volume is provisioned for.
+	PVC *v1.PersistentVolumeClaim
+	// CHAP credentials to configure on the target, nil for none.
+	Chap *chapCredentials
+	// Initiator IQNs allowed to log in if ACL is true.
+	Initiators []string
+	// ACL is true if only Initiators may log in, any initiator may log in
+	// otherwise.
+	ACL bool
+	// Target and LUN to export the volume as, allocated by the controller.
+	// Nil lets the driver choose.
+	Target *targetLun
 	// Volume provisioning parameters from StorageClass
 	Parameters map[string]string
 }
 
 
-// provision creates a volume i.e. the storage asset and returns a PV object for
-// the volume
-func (ctrl *iscsiController) provision(options VolumeOptions) (*v1.PersistentVolume, error) {
-	server, path, err := ctrl.createVolume(options.PVName)
-	if err != nil {
-		return nil, err
+// provision creates a volume i.e. the storage asset with the given function
+// and returns a PV object for the volume
+func (ctrl *iscsiController) provision(options VolumeOptions, params *classParameters, create func(VolumeOptions) (*Volume, error)) (*v1.PersistentVolume, error) {
+	var volume *Volume
+	var err error
+	// A previous attempt may have created the volume before we failed to save
+	// its PV, reuse it if the driver can tell.
+	if getter, ok := ctrl.driver.(Getter); ok {
+		if volume, err = getter.Get(options.PVName); err != nil {
+			return nil, err
+		}
+	}
+	if volume == nil {
+		if volume, err = create(options); err != nil {
+			return nil, err
+		}
+	}
+	if len(volume.Portals) == 0 || volume.IQN == "" {
+		return nil, fmt.Errorf("driver returned volume without target portal or IQN")
+	}
+	glog.V(1).Infof("Portals, IQN and lun returned :%v %v %v", volume.Portals, volume.IQN, volume.Lun)
+
+	capacity := options.Capacity
+	if !volume.Size.IsZero() {
+		capacity = volume.Size
+		if capacity.Cmp(options.Capacity) < 0 {
+			glog.Warningf("volume %q is %s, smaller than the requested %s", options.PVName, capacity.String(), options.Capacity.String())
+		}
+	}
+	portals := volume.Portals
+	if len(params.portals) > 0 {
+		portals = params.portals
+	}
+	if params.targetPortal != "" {
+		portals = append([]string{params.targetPortal}, portals...)
+	}
+	portals = uniquePortals(portals)
+	iscsi := &v1.ISCSIVolumeSource{
+		TargetPortal:   portals[0],
+		IQN:            volume.IQN,
+		Lun:            volume.Lun,
+		ISCSIInterface: params.iscsiInterface,
+		FSType:         volume.FSType,
+		ReadOnly:       params.readOnly,
+	}
+	if params.iqn != "" {
+		iscsi.IQN = params.iqn
+	}
+	if params.lun != nil {
+		iscsi.Lun = *params.lun
+	}
+	if params.fsType != "" {
+		iscsi.FSType = params.fsType
+	}
+	if iscsi.FSType == "" {
+		iscsi.FSType = "ext3"
 	}
-	glog.V(1).Infof("Server and path returned :%v %v", server, path)
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
 			Name:   options.PVName,
 			Labels: map[string]string{},
 			Annotations: map[string]string{
 				"kubernetes.io/createdby": "iscsi-dynamic-provisioner",
+				annExecMode:               ctrl.provisionerConfig.Opmode,
 			},
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
 			AccessModes:                   options.AccessModes,
 			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): options.Capacity,
+				v1.ResourceName(v1.ResourceStorage): capacity,
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				ISCSI: &v1.ISCSIVolumeSource{
-					TargetPortal: server,
-					IQN: path,
-     				Lun: 0,
-     				FSType: "ext3",
-     			    ReadOnly: false,
-					
-				},
+				ISCSI: iscsi,
 			},
 		},
 	}
 
-	return pv, nil
-}
-
-// createVolume creates a volume i.e. the storage asset.
-
-
-func (ctrl *iscsiController) createVolume(PVName string) (string, string, error) {
-	var server,path string
-	if ctrl.provisionerConfig.Opmode == "script" {
-			cmd := exec.Command("sh", ctrl.provisionerConfig.Scriptpath)
-			var out bytes.Buffer
-			cmd.Stdout = &out
-			err := cmd.Run()
-			if err != nil {
-					glog.Errorf("%v", err)
-			}
-			result := strings.Fields(out.String())
-			server = result[0]
-			path = result[1]
+	if volume.BackendID != "" {
+		setAnnotation(&pv.ObjectMeta, annBackendID, volume.BackendID)
 	}
-	return server, path, nil
+	for key, value := range volume.Annotations {
+		setAnnotation(&pv.ObjectMeta, key, value)
+	}
+	if options.Target != nil {
+		setAnnotation(&pv.ObjectMeta, annSharedTarget, options.Target.String())
+	}
+	if options.Chap != nil && options.PVC != nil {
+		setAnnotation(&pv.ObjectMeta, annChapSecret, options.PVC.Namespace+"/"+chapSecretName(options.PVName))
+	}
+	// TODO: set ISCSIVolumeSource.Portals once the API has it.
+	if len(portals) > 1 {
+		setAnnotation(&pv.ObjectMeta, annAlternatePortals, strings.Join(portals[1:], ","))
+	}
+	if params.nodeACL {
+		acl := newACLState(params, options.AccessModes)
+		acl.Current = options.Initiators
+		if err := setACLState(&pv.ObjectMeta, acl); err != nil {
+			return nil, err
+		}
+	}
+
+	return pv, nil
 }
 
 func (ctrl *iscsiController) deleteVolumeOperation(volume *v1.PersistentVolume) {
@@ -467,12 +949,28 @@ func (ctrl *iscsiController) deleteVolumeOperation(volume *v1.PersistentVolume)
 		return
 	}
 
-	if err := ctrl.delete(volume); err != nil {
+	if newVolume.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain {
+		glog.V(2).Infof("deleting retained volume %q as requested by its %s annotation", volume.Name, annDeleteRetained)
+	}
+	if retention := trashRetention(newVolume); retention > 0 {
+		// Trashed volumes are wiped when they are purged.
+		err = ctrl.trashVolume(newVolume, retention)
+	} else if !ctrl.wipeVolume(newVolume) {
+		return
+	} else {
+		// Wiping unexported the volume, no initiator could write to
+		// it since.
+		err = ctrl.delete(newVolume)
+	}
+	if err != nil {
 		// Delete failed, emit an event.
 		glog.V(3).Infof("deletion of volume %q failed: %v", volume.Name, err)
 		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", err.Error())
 		return
 	}
+	if _, shared := newVolume.Annotations[annSharedTarget]; shared {
+		ctrl.releaseLun(volume.Name)
+	}
 
 	glog.V(4).Infof("deleteVolumeOperation [%s]: success", volume.Name)
 	// Delete the volume
@@ -486,13 +984,133 @@ func (ctrl *iscsiController) deleteVolumeOperation(volume *v1.PersistentVolume)
 	return
 }
 
-// delete removes the directory backing the given PV that was created by
-// createVolume.
+// delete removes the storage asset backing the given PV that was created by
+// provision.
 func (ctrl *iscsiController) delete(volume *v1.PersistentVolume) error {
-	// TODO quota, something better than just directories
+	if err := ctrl.driver.Delete(volume); err != nil {
+		return err
+	}
+	return ctrl.deleteChapSecret(volume)
+}
+
+// claimChapCredentials returns the CHAP credentials of the volume provisioned
+// for a claim in the given namespace. They are generated and saved in their
+// Secret on the first attempt, before any backend sees them, and read back
+// on later attempts so that a volume created by a failed attempt keeps
+// matching its Secret.
+func (ctrl *iscsiController) claimChapCredentials(namespace, pvName string, mutual bool) (*chapCredentials, error) {
+	secrets := ctrl.client.Core().Secrets(namespace)
+	name := chapSecretName(pvName)
+	secret, err := secrets.Get(name)
+	if err == nil {
+		chap, err := chapFromSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		if mutual != (chap.MutualUsername != "") {
+			return nil, fmt.Errorf("secret %s/%s does not hold the expected CHAP credentials", namespace, name)
+		}
+		return chap, nil
+	}
+	if !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("error reading CHAP secret %s/%s: %v", namespace, name, err)
+	}
+	chap, err := newChapCredentials(pvName, mutual)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = secrets.Create(newChapSecret(namespace, name, chap)); err != nil {
+		return nil, fmt.Errorf("error saving CHAP secret %s/%s: %v", namespace, name, err)
+	}
+	return chap, nil
+}
+
+// updateConfigMap applies update to the data of the given ConfigMap, which is
+// created if it does not exist, and saves it unless update returns false.
+// Concurrent changes of the ConfigMap are retried.
+func (ctrl *iscsiController) updateConfigMap(namespace, name string, update func(data map[string]string) bool) error {
+	ctrl.configMapsLock.Lock()
+	defer ctrl.configMapsLock.Unlock()
+	configMaps := ctrl.client.Core().ConfigMaps(namespace)
+	var err error
+	for i := 0; i < configMapRetryCount; i++ {
+		var configMap *v1.ConfigMap
+		configMap, err = configMaps.Get(name)
+		create := apierrs.IsNotFound(err)
+		if create {
+			configMap = &v1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace}}
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		if !update(configMap.Data) {
+			return nil
+		}
+
+		if create {
+			_, err = configMaps.Create(configMap)
+		} else {
+			_, err = configMaps.Update(configMap)
+		}
+		if err == nil || !(apierrs.IsConflict(err) || apierrs.IsAlreadyExists(err)) {
+			break
+		}
+		// Somebody else changed the ConfigMap, retry with their version.
+		glog.V(4).Infof("ConfigMap %s/%s changed while updating it, retrying", namespace, name)
+	}
+	return err
+}
+
+// deleteChapSecret deletes the Secret holding the CHAP credentials of a
+// volume, if it has one.
+func (ctrl *iscsiController) deleteChapSecret(volume *v1.PersistentVolume) error {
+	namespace, name, err := getChapSecretRef(volume)
+	if err != nil || name == "" {
+		return err
+	}
+	return ctrl.deleteSecret(namespace, name)
+}
+
+// deleteSecret deletes the Secret holding CHAP credentials with the given
+// namespace and name, if it exists.
+func (ctrl *iscsiController) deleteSecret(namespace, name string) error {
+	err := ctrl.client.Core().Secrets(namespace).Delete(name, nil)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("error deleting CHAP secret %s/%s: %v", namespace, name, err)
+	}
 	return nil
 }
 
+// getChapCredentials reads the CHAP credentials of a volume from its Secret,
+// nil if it has none.
+func (ctrl *iscsiController) getChapCredentials(volume *v1.PersistentVolume) (*chapCredentials, error) {
+	namespace, name, err := getChapSecretRef(volume)
+	if err != nil || name == "" {
+		return nil, err
+	}
+	secret, err := ctrl.client.Core().Secrets(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CHAP secret %s/%s: %v", namespace, name, err)
+	}
+	return chapFromSecret(secret)
+}
+
+// getChapSecretRef returns the namespace and name of the Secret holding the
+// CHAP credentials of a volume, empty if it has none.
+func getChapSecretRef(volume *v1.PersistentVolume) (string, string, error) {
+	ref, found := volume.Annotations[annChapSecret]
+	if !found {
+		return "", "", nil
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid %s annotation %q", annChapSecret, ref)
+	}
+	return parts[0], parts[1], nil
+}
+
 // scheduleOperation starts given asynchronous operation on given volume. It
 // makes sure the operation is already not running.
 func (ctrl *iscsiController) scheduleOperation(operationName string, operation func() error) {
@@ -508,6 +1126,53 @@ func (ctrl *iscsiController) scheduleOperation(operationName string, operation f
 	}
 }
 
+// volumeOperationName returns the name of the operations changing the storage
+// asset of a volume, deletion and expansion, which must not run concurrently.
+func volumeOperationName(volume *v1.PersistentVolume) string {
+	return fmt.Sprintf("volume-%s[%s]", volume.Name, string(volume.UID))
+}
+
+// claimFailure records a claim whose provisioning failed permanently. It is
+// retried if the claim or its StorageClass changes.
+type claimFailure struct {
+	// ResourceVersion of the claim.
+	claimVersion string
+	// ResourceVersion of the StorageClass of the claim.
+	classVersion string
+}
+
+// setClaimFailed stops provisioning from being retried for the given claim
+// until it or its StorageClass changes.
+func (ctrl *iscsiController) setClaimFailed(claim *v1.PersistentVolumeClaim) {
+	failure := claimFailure{claimVersion: claim.ResourceVersion, classVersion: ctrl.classVersion(getClaimClass(claim))}
+	ctrl.failedClaimsLock.Lock()
+	defer ctrl.failedClaimsLock.Unlock()
+	ctrl.failedClaims[string(claim.UID)] = failure
+}
+
+// getBackendID returns the backend identity of the storage asset of the given
+// PV, defaulting to the PV name for drivers that did not report one.
+func getBackendID(volume *v1.PersistentVolume) string {
+	if id := volume.Annotations[annBackendID]; id != "" {
+		return id
+	}
+	return volume.Name
+}
+
+// deleteRetainedRequested returns true if an admin asked for the storage of a
+// retained volume to be deleted.
+func deleteRetainedRequested(volume *v1.PersistentVolume) bool {
+	value, found := volume.Annotations[annDeleteRetained]
+	if !found {
+		return false
+	}
+	requested, err := strconv.ParseBool(value)
+	if err != nil {
+		glog.V(3).Infof("ignoring invalid %s annotation %q of volume %q", annDeleteRetained, value, volume.Name)
+	}
+	return requested
+}
+
 func hasAnnotation(obj v1.ObjectMeta, ann string) bool {
 	_, found := obj.Annotations[ann]
 	return found
@@ -540,6 +1205,21 @@ func (ctrl *iscsiController) getProvisionedVolumeNameForClaim(claim *v1.Persiste
 	return "pvc-" + string(claim.UID)
 }
 
+// uniquePortals removes duplicates from a list of portals, keeping the first
+// occurrence of each. Portals with and without the default port are the
+// same.
+func uniquePortals(portals []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, portal := range portals {
+		if address := portalAddress(portal); !seen[address] {
+			seen[address] = true
+			unique = append(unique, portal)
+		}
+	}
+	return unique
+}
+
 func claimToClaimKey(claim *v1.PersistentVolumeClaim) string {
 	return fmt.Sprintf("%s/%s", claim.Namespace, claim.Name)
 }
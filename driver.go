@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Driver creates and deletes the storage assets backing the PVs of this
+// provisioner. Every execmode is implemented by a Driver registered under the
+// execmode's name.
+//
+// Drivers may also implement the optional capability interfaces defined
+// below; the controller checks for them with a type assertion.
+type Driver interface {
+	// Provision creates a volume for the given options.
+	Provision(options VolumeOptions) (*Volume, error)
+	// Delete deletes the volume backing the given PV. Deleting a volume
+	// that does not exist anymore is not an error.
+	Delete(volume *v1.PersistentVolume) error
+}
+
+// ParameterValidator is implemented by drivers that accept a fixed set of
+// StorageClass parameters. Drivers that do not implement it accept any
+// parameter, e.g. to pass it on to an external backend.
+type ParameterValidator interface {
+	// ValidateParameters checks the StorageClass parameters left to the
+	// driver by the controller.
+	ValidateParameters(parameters map[string]string) error
+}
+
+// Getter is implemented by drivers that can look up a volume they have
+// provisioned before.
+type Getter interface {
+	// Get returns the volume created for the PV with the given name or nil
+	// if there is no such volume.
+	Get(pvName string) (*Volume, error)
+}
+
+// UsageReporter is implemented by drivers that know how much backend storage
+// a volume really occupies, e.g. because it is thin provisioned.
+type UsageReporter interface {
+	// Usage returns the bytes allocated on the backend to the given PV,
+	// or -1 if the backend does not track them for that volume.
+	Usage(volume *v1.PersistentVolume) (int64, error)
+}
+
+// InitiatorManager is implemented by drivers that can change the initiators
+// allowed to log in to the target of an existing volume.
+type InitiatorManager interface {
+	// SetInitiators allows exactly the given initiators to log in to the
+	// target of the given PV. chap holds the CHAP credentials of the
+	// volume, nil for none.
+	SetInitiators(volume *v1.PersistentVolume, initiators []string, chap *chapCredentials) error
+}
+
+// SizeRounder is implemented by drivers that allocate storage in fixed
+// units.
+type SizeRounder interface {
+	// RoundSize returns the size in bytes of the volume the driver creates
+	// for the given requested size and driver parameters.
+	RoundSize(size int64, parameters map[string]string) (int64, error)
+}
+
+// Expander is implemented by drivers that can grow volumes while they are
+// in use.
+type Expander interface {
+	// Expand grows the volume backing the given PV to at least size bytes
+	// and returns its new size.
+	Expand(volume *v1.PersistentVolume, size int64) (int64, error)
+}
+
+// Snapshotter is implemented by drivers that can take point in time
+// snapshots of volumes.
+type Snapshotter interface {
+	// Snapshot creates a snapshot with the given name of the volume backing
+	// the given PV. Creating a snapshot that exists already returns it.
+	Snapshot(volume *v1.PersistentVolume, name string) (*Snapshot, error)
+	// DeleteSnapshot deletes the snapshot with the given ID. Deleting a
+	// snapshot that does not exist anymore is not an error.
+	DeleteSnapshot(id string) error
+	// ListSnapshots returns the IDs of the snapshots of the volume backing
+	// the given PV by snapshot name.
+	ListSnapshots(volume *v1.PersistentVolume) (map[string]string, error)
+}
+
+// Snapshot describes a snapshot created by a Snapshotter.
+type Snapshot struct {
+	// ID identifies the snapshot on the backend.
+	ID string
+	// Size of the volume when the snapshot was taken, in bytes.
+	SizeBytes int64
+	// CreationTime of the snapshot.
+	CreationTime time.Time
+}
+
+// Cloner is implemented by drivers that can provision volumes with the data
+// of a snapshot or of another volume.
+type Cloner interface {
+	// Clone creates a volume for the given options like Provision does,
+	// with a copy of the data of the given source. The capacity of the
+	// options is at least the size of the source.
+	Clone(options VolumeOptions, source *CloneSource) (*Volume, error)
+}
+
+// CloneSource is the data a volume is cloned from, either a snapshot or a
+// volume provisioned by the same driver.
+type CloneSource struct {
+	// SnapshotID of the snapshot to clone, as returned by the Snapshotter.
+	SnapshotID string
+	// BackendID of the volume to clone if SnapshotID is empty.
+	BackendID string
+	// Size of the source in bytes.
+	SizeBytes int64
+}
+
+// Trasher is implemented by drivers that can keep the volumes of deleted PVs
+// for a while instead of deleting them.
+type Trasher interface {
+	// Trash unexports the volume backing the given PV and moves it to the
+	// trash. It returns the ID of the volume in the trash. Trashing a
+	// volume that is in the trash already returns the same ID.
+	Trash(volume *v1.PersistentVolume) (string, error)
+	// Restore moves the volume with the given ID out of the trash and
+	// exports it like Provision does for the given options. Restoring a
+	// volume that was restored for the same options already exports it.
+	Restore(id string, options VolumeOptions) (*Volume, error)
+	// Purge deletes the volume with the given ID from the trash. Purging a
+	// volume that is not in the trash anymore is not an error.
+	Purge(id string) error
+}
+
+// Wiper is implemented by drivers that can erase the data of volumes before
+// they are deleted.
+type Wiper interface {
+	// CanWipe returns true if the driver supports the given wipe policy.
+	CanWipe(policy string) bool
+	// Wipe erases the data of the volume backing the given PV with the
+	// given wipe policy. Drivers exporting volumes themselves remove the
+	// volume from its target first.
+	Wipe(volume *v1.PersistentVolume, policy string) error
+}
+
+// TargetExporter is implemented by drivers that export volumes as LUNs of
+// targets they configure themselves. They export a volume as the target and
+// LUN of VolumeOptions.Target when it is set, which may be shared with other
+// volumes.
+type TargetExporter interface {
+	// FirstLun returns the lowest LUN number volumes can be exported as.
+	FirstLun() int32
+}
+
+// Volume describes a volume created by a Driver.
+type Volume struct {
+	// Portals the target can be reached at, as host or host:port. The first
+	// one is the primary portal.
+	Portals []string
+	// IQN of the target.
+	IQN string
+	// LUN of the volume on the target.
+	Lun int32
+	// Filesystem the volume is to be formatted with, empty for the default.
+	FSType string
+	// Size of the created volume. Zero if the driver does not know it, in
+	// which case the requested capacity is assumed.
+	Size resource.Quantity
+	// BackendID identifies the volume on the backend.
+	BackendID string
+	// Annotations the driver needs on the PV of the volume.
+	Annotations map[string]string
+}
+
+// driverFactory creates a Driver from the provisioner configuration.
+type driverFactory func(config ProvisionerConfig) (Driver, error)
+
+var drivers = make(map[string]driverFactory)
+
+// registerDriver makes a Driver available as execmode name. It is meant to
+// be called from init functions.
+func registerDriver(name string, factory driverFactory) {
+	if _, found := drivers[name]; found {
+		panic(fmt.Sprintf("driver %q registered twice", name))
+	}
+	drivers[name] = factory
+}
+
+// newDriver creates the Driver for the configured execmode.
+func newDriver(config ProvisionerConfig) (Driver, error) {
+	factory, found := drivers[config.Opmode]
+	if !found {
+		return nil, fmt.Errorf("unknown execmode %q, must be one of %s", config.Opmode, strings.Join(driverNames(), ", "))
+	}
+	return factory(config)
+}
+
+// driverNames returns the sorted names of all registered drivers.
+func driverNames() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// temporary is implemented by driver errors that know whether the failed
+// operation may succeed when it is retried.
+type temporary interface {
+	Temporary() bool
+}
+
+// permanentError is a driver error that does not go away on retry.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Temporary() bool {
+	return false
+}
+
+// isTemporary returns false if err is known not to go away on retry.
+func isTemporary(err error) bool {
+	if t, ok := err.(temporary); ok {
+		return t.Temporary()
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
+)
+
+// This annotation can be set on a claim to request more storage on clusters
+// that do not allow changing the resource requests of bound claims. Its value
+// is a quantity like "20Gi".
+const annRequestedStorage = "iscsi-provisioner/requested-storage"
+
+// expansionFailure records an expansion that failed permanently. It is
+// retried if the claim requests another size or the StorageClass changes.
+type expansionFailure struct {
+	// Size the claim could not be expanded to.
+	size int64
+	// ResourceVersion of the StorageClass of the volume.
+	classVersion string
+}
+
+// claimRequestedSize returns the bytes requested by a claim, either in its
+// resource requests or in its annRequestedStorage annotation.
+func claimRequestedSize(claim *v1.PersistentVolumeClaim) int64 {
+	requested := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	size := requested.Value()
+	if value, found := claim.Annotations[annRequestedStorage]; found {
+		annotated, err := resource.ParseQuantity(value)
+		if err != nil {
+			glog.V(3).Infof("ignoring invalid %s annotation %q of claim %q: %v", annRequestedStorage, value, claimToClaimKey(claim), err)
+		} else if annotated.Value() > size {
+			size = annotated.Value()
+		}
+	}
+	return size
+}
+
+// shouldExpand returns the volume bound to the given claim if it is ours and
+// smaller than the claim requests.
+func (ctrl *iscsiController) shouldExpand(claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
+	if _, ok := ctrl.driver.(Expander); !ok {
+		return nil
+	}
+	if claim.Spec.VolumeName == "" || claim.Status.Phase != v1.ClaimBound {
+		return nil
+	}
+	obj, found, err := ctrl.volumes.GetByKey(claim.Spec.VolumeName)
+	if err != nil || !found {
+		return nil
+	}
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok || !ctrl.volumeNeedsExpansion(volume, claim) {
+		return nil
+	}
+
+	failure := expansionFailure{size: claimRequestedSize(claim), classVersion: ctrl.classVersion(volume.Annotations[annClass])}
+	ctrl.failedClaimsLock.Lock()
+	failed := ctrl.failedExpansions[string(claim.UID)] == failure
+	ctrl.failedClaimsLock.Unlock()
+	if failed {
+		return nil
+	}
+	return volume
+}
+
+// classVersion returns the ResourceVersion of the StorageClass with the given
+// name, empty if it is not found.
+func (ctrl *iscsiController) classVersion(name string) string {
+	obj, found, err := ctrl.classes.GetByKey(name)
+	if err != nil || !found {
+		return ""
+	}
+	class, ok := obj.(*v1beta1.StorageClass)
+	if !ok {
+		return ""
+	}
+	return class.ResourceVersion
+}
+
+// volumeNeedsExpansion returns true if the given volume provisioned by us is
+// bound to the given claim, which requests more than its capacity.
+func (ctrl *iscsiController) volumeNeedsExpansion(volume *v1.PersistentVolume, claim *v1.PersistentVolumeClaim) bool {
+	if volume.Status.Phase != v1.VolumeBound || volume.Spec.ClaimRef == nil || volume.Spec.ClaimRef.UID != claim.UID {
+		return false
+	}
+	if volume.Annotations[annDynamicallyProvisioned] != ctrl.provisionerName ||
+		volume.Annotations[annExecMode] != ctrl.provisionerConfig.Opmode {
+		return false
+	}
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	return claimRequestedSize(claim) > capacity.Value()
+}
+
+// expandVolumeOperation grows the volume bound to a claim to the size the
+// claim requests, if its StorageClass allows expansion.
+func (ctrl *iscsiController) expandVolumeOperation(claim *v1.PersistentVolumeClaim, volume *v1.PersistentVolume) {
+	glog.V(4).Infof("expandVolumeOperation [%s] started", volume.Name)
+
+	// The volume may have been deleted or expanded while we were waiting.
+	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
+	if err != nil {
+		glog.V(3).Infof("error reading peristent volume %q: %v", volume.Name, err)
+		return
+	}
+	if !ctrl.volumeNeedsExpansion(newVolume, claim) {
+		glog.V(3).Infof("volume %q no longer needs expansion, skipping", volume.Name)
+		return
+	}
+	size := claimRequestedSize(claim)
+
+	params, driverParameters, err := ctrl.volumeClassParameters(newVolume)
+	if err != nil {
+		glog.V(3).Infof("cannot expand volume %q: %v", volume.Name, err)
+		return
+	}
+	// The volume is grown to the rounded size, which must not exceed
+	// maxSize either.
+	rounded := size
+	if rounder, ok := ctrl.driver.(SizeRounder); ok {
+		if rounded, err = rounder.RoundSize(size, driverParameters); err != nil {
+			glog.V(3).Infof("cannot expand volume %q: %v", volume.Name, err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "VolumeExpansionFailed", fmt.Sprintf("Failed to expand volume %s: %v", volume.Name, err))
+			return
+		}
+	}
+	if !params.allowExpansion {
+		err = fmt.Errorf("StorageClass %q does not allow expansion", newVolume.Annotations[annClass])
+	} else if params.maxSize > 0 && rounded > params.maxSize {
+		err = fmt.Errorf("requested size %d bytes, %d bytes once rounded, exceeds %s %d bytes", size, rounded, paramMaxSize, params.maxSize)
+	}
+	if err != nil {
+		ctrl.setExpansionFailed(claim, newVolume, size)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "VolumeExpansionFailed", fmt.Sprintf("Cannot expand volume %s: %v", volume.Name, err))
+		return
+	}
+
+	capacity := newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "VolumeExpanding", fmt.Sprintf("Expanding volume %s from %s to %d bytes", volume.Name, capacity.String(), size))
+	newSize, err := ctrl.driver.(Expander).Expand(newVolume, size)
+	if err != nil {
+		strerr := fmt.Sprintf("Failed to expand volume %s: %v", volume.Name, err)
+		if !isTemporary(err) {
+			strerr += ", not retrying"
+			ctrl.setExpansionFailed(claim, newVolume, size)
+		}
+		glog.V(3).Info(strerr)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "VolumeExpansionFailed", strerr)
+		return
+	}
+
+	newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)] = *resource.NewQuantity(newSize, resource.BinarySI)
+	for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
+		if _, err = ctrl.client.Core().PersistentVolumes().Update(newVolume); err == nil {
+			break
+		}
+		glog.V(3).Infof("failed to update capacity of volume %q: %v", volume.Name, err)
+		// The volume may have changed, e.g. its annotations, retry with
+		// the current version.
+		if current, getErr := ctrl.client.Core().PersistentVolumes().Get(volume.Name); getErr == nil {
+			current.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)] = newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+			newVolume = current
+		}
+	}
+	if err != nil {
+		strerr := fmt.Sprintf("Volume %s was expanded to %d bytes but its capacity could not be updated: %v", volume.Name, newSize, err)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "VolumeExpansionFailed", strerr)
+		return
+	}
+	glog.V(2).Infof("volume %q for claim %q expanded to %d bytes", volume.Name, claimToClaimKey(claim), newSize)
+	ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "VolumeExpanded", fmt.Sprintf("Expanded volume %s to %d bytes", volume.Name, newSize))
+}
+
+// volumeClassParameters returns the parameters of the StorageClass a volume
+// was provisioned with and those of the driver.
+func (ctrl *iscsiController) volumeClassParameters(volume *v1.PersistentVolume) (*classParameters, map[string]string, error) {
+	className := volume.Annotations[annClass]
+	classObj, found, err := ctrl.classes.GetByKey(className)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting StorageClass %q: %v", className, err)
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("StorageClass %q not found", className)
+	}
+	class, ok := classObj.(*v1beta1.StorageClass)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot convert object to StorageClass: %+v", classObj)
+	}
+	return parseClassParameters(class.Parameters)
+}
+
+// setExpansionFailed stops expansion of the given volume to the given size
+// from being retried for the given claim until its StorageClass changes.
+func (ctrl *iscsiController) setExpansionFailed(claim *v1.PersistentVolumeClaim, volume *v1.PersistentVolume, size int64) {
+	ctrl.failedClaimsLock.Lock()
+	defer ctrl.failedClaimsLock.Unlock()
+	ctrl.failedExpansions[string(claim.UID)] = expansionFailure{size: size, classVersion: ctrl.classVersion(volume.Annotations[annClass])}
+}
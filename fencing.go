@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Nodes that are NotReady for longer than the fencing grace period are
+// fenced: their initiators are left out of the ACLs of the volumes
+// provisioned with nodeACL, so that a node that lost contact with the cluster
+// cannot keep writing to volumes whose pods were started elsewhere. Fenced
+// nodes get access again once they are Ready. Volumes without an ACL are not
+// fenced, and nodes are only watched once a volume with an ACL exists, see
+// watchNodes.
+
+// nodeFailed returns true if a node has been NotReady for at least the given
+// grace period at the given time.
+func nodeFailed(node *v1.Node, gracePeriod time.Duration, now time.Time) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+		return condition.Status != v1.ConditionTrue && now.Sub(condition.LastTransitionTime.Time) >= gracePeriod
+	}
+	return false
+}
+
+// updateFencing fences or unfences a node according to its Ready condition
+// and returns true if that changed.
+func (ctrl *iscsiController) updateFencing(node *v1.Node) bool {
+	gracePeriod := ctrl.provisionerConfig.FencingGracePeriod
+	if gracePeriod <= 0 {
+		return false
+	}
+	failed := nodeFailed(node, gracePeriod, time.Now())
+
+	ctrl.fencedNodesLock.Lock()
+	_, fenced := ctrl.fencedNodes[node.Name]
+	if failed == fenced {
+		ctrl.fencedNodesLock.Unlock()
+		return false
+	}
+	initiator := nodeInitiator(node)
+	if failed {
+		ctrl.fencedNodes[node.Name] = initiator
+	} else {
+		delete(ctrl.fencedNodes, node.Name)
+	}
+	ctrl.fencedNodesLock.Unlock()
+
+	if failed {
+		msg := fmt.Sprintf("Node not ready for more than %v, revoking access of initiator %q to the volumes of %s", gracePeriod, initiator, ctrl.provisionerName)
+		glog.Warningf("fencing node %q: %s", node.Name, msg)
+		ctrl.eventRecorder.Event(node, v1.EventTypeWarning, "NodeFenced", msg)
+	} else {
+		msg := fmt.Sprintf("Node ready again, restoring access of initiator %q to the volumes of %s", initiator, ctrl.provisionerName)
+		glog.Infof("unfencing node %q: %s", node.Name, msg)
+		ctrl.eventRecorder.Event(node, v1.EventTypeNormal, "NodeUnfenced", msg)
+	}
+	return true
+}
+
+// forgetFencing drops a deleted node from the fenced nodes.
+func (ctrl *iscsiController) forgetFencing(nodeName string) {
+	ctrl.fencedNodesLock.Lock()
+	defer ctrl.fencedNodesLock.Unlock()
+	delete(ctrl.fencedNodes, nodeName)
+}
+
+func (ctrl *iscsiController) isFenced(nodeName string) bool {
+	ctrl.fencedNodesLock.Lock()
+	defer ctrl.fencedNodesLock.Unlock()
+	_, fenced := ctrl.fencedNodes[nodeName]
+	return fenced
+}
+
+// fencedInitiators returns the names of the fenced nodes by the IQN of their
+// initiators.
+func (ctrl *iscsiController) fencedInitiators() map[string]string {
+	ctrl.fencedNodesLock.Lock()
+	defer ctrl.fencedNodesLock.Unlock()
+	initiators := make(map[string]string)
+	for node, initiator := range ctrl.fencedNodes {
+		if initiator != "" {
+			initiators[initiator] = node
+		}
+	}
+	return initiators
+}
@@ -0,0 +1,16 @@
+package main
+
+func init() {
+	registerDriver("file", newFileDriver)
+}
+
+// newFileDriver returns the driver of the file execmode, which provisions
+// volumes as image files exported as fileio LUNs by the target layer chosen
+// with -target-layer.
+func newFileDriver(config ProvisionerConfig) (Driver, error) {
+	target, err := newTargetLayer(config)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalDriver("file", target, false, config)
+}
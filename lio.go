@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	registerDriver("lio", newLIODriver)
+}
+
+const (
+	// HBAs the backstores of this provisioner are created in.
+	lioFileIOHBA = "fileio_0"
+	lioBlockHBA  = "iblock_0"
+
+	// Name of the symlinks mapping a backstore to a LUN and a LUN to an ACL.
+	lioLunLink = "iscsi-provisioner"
+)
+
+// lioTarget is a targetLayer configuring the LIO kernel target through its
+// configfs tree, usually mounted at /sys/kernel/config/target.
+type lioTarget struct {
+	root string
+	fs   configfsTree
+}
+
+func newLIOTarget(root string) *lioTarget {
+	return &lioTarget{root: root, fs: configfs{}}
+}
+
+// configfsTree changes a configfs tree, which is read like any other
+// directory tree.
+type configfsTree interface {
+	// MkdirAll creates a group and any missing parents.
+	MkdirAll(path string) error
+	// WriteAttribute sets an attribute.
+	WriteAttribute(path, value string) error
+	// RemoveGroup removes a group unless it does not exist. configfs
+	// removes its attributes and default groups with it.
+	RemoveGroup(path string) error
+}
+
+// configfs is the configfsTree of the kernel.
+type configfs struct{}
+
+func (configfs) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (configfs) WriteAttribute(path, value string) error {
+	glog.V(5).Infof("setting %s to %q", path, value)
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+func (configfs) RemoveGroup(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (t *lioTarget) FirstLun() int32 {
+	return 0
+}
+
+func (t *lioTarget) Export(e *export) error {
+	device, err := t.createBackstore(e)
+	if err != nil {
+		return fmt.Errorf("error creating LIO backstore %q: %v", e.Name, err)
+	}
+
+	tpg := t.tpgPath(e.IQN)
+	if err := t.fs.MkdirAll(tpg); err != nil {
+		return fmt.Errorf("error creating LIO target %q: %v", e.IQN, err)
+	}
+	lun := t.lunPath(e.IQN, e.Lun)
+	if err := t.fs.MkdirAll(lun); err != nil {
+		return err
+	}
+	if err := symlink(device, filepath.Join(lun, lioLunLink)); err != nil {
+		return err
+	}
+	for _, portal := range e.Portals {
+		if err := t.fs.MkdirAll(filepath.Join(tpg, "np", portalAddress(portal))); err != nil {
+			return fmt.Errorf("error creating LIO portal %q: %v", portal, err)
+		}
+	}
+	if err := t.setACLs(e, !e.ACL); err != nil {
+		return err
+	}
+	return t.fs.WriteAttribute(filepath.Join(tpg, "enable"), "1")
+}
+
+func (t *lioTarget) Unexport(e *export) error {
+	tpg := t.tpgPath(e.IQN)
+	if _, err := os.Stat(tpg); err == nil {
+		if err := t.removeLun(e.IQN, e.Lun); err != nil {
+			return err
+		}
+		luns, err := ioutil.ReadDir(filepath.Join(tpg, "lun"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(luns) == 0 {
+			if err := t.removeTarget(e.IQN); err != nil {
+				return fmt.Errorf("error removing LIO target %q: %v", e.IQN, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, hba := range []string{lioFileIOHBA, lioBlockHBA} {
+		if err := t.fs.RemoveGroup(filepath.Join(t.root, "core", hba, e.Name)); err != nil {
+			return fmt.Errorf("error removing LIO backstore %q: %v", e.Name, err)
+		}
+	}
+	return nil
+}
+
+func (t *lioTarget) SetInitiators(e *export) error {
+	tpg := t.tpgPath(e.IQN)
+	if _, err := os.Stat(t.lunPath(e.IQN, e.Lun)); err != nil {
+		return fmt.Errorf("error looking up LUN %d of LIO target %q: %v", e.Lun, e.IQN, err)
+	}
+	allowed := make(map[string]bool)
+	for _, initiator := range e.Initiators {
+		allowed[initiator] = true
+	}
+	acls, err := ioutil.ReadDir(filepath.Join(tpg, "acls"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, acl := range acls {
+		if allowed[acl.Name()] {
+			continue
+		}
+		if err := t.removeMappedLun(e.IQN, acl.Name(), e.Lun); err != nil {
+			return fmt.Errorf("error removing LIO ACL for %q: %v", acl.Name(), err)
+		}
+	}
+	return t.setACLs(e, !e.ACL)
+}
+
+// CanResize succeeds for block backstores, LIO reads the size of their
+// device on every request. The size of fileio backstores is fixed.
+func (t *lioTarget) CanResize(e *export) error {
+	if _, err := os.Stat(filepath.Join(t.root, "core", lioFileIOHBA, e.Name)); err == nil {
+		return permanentError{fmt.Errorf("LIO cannot resize fileio backstore %q online", e.Name)}
+	}
+	if _, err := os.Stat(filepath.Join(t.root, "core", lioBlockHBA, e.Name)); err != nil {
+		return fmt.Errorf("error looking up LIO backstore %q: %v", e.Name, err)
+	}
+	return nil
+}
+
+// Resize does nothing for block backstores.
+func (t *lioTarget) Resize(e *export) error {
+	return t.CanResize(e)
+}
+
+// createBackstore creates the backstore of e unless it exists and returns its
+// path.
+func (t *lioTarget) createBackstore(e *export) (string, error) {
+	hba, control := lioBlockHBA, fmt.Sprintf("udev_path=%s", e.Path)
+	if e.FileIO {
+		if e.Size <= 0 {
+			return "", fmt.Errorf("fileio backstore needs a size")
+		}
+		hba, control = lioFileIOHBA, fmt.Sprintf("fd_dev_name=%s,fd_dev_size=%d", e.Path, e.Size)
+	}
+	device := filepath.Join(t.root, "core", hba, e.Name)
+	if enabled, err := ioutil.ReadFile(filepath.Join(device, "enable")); err == nil && strings.TrimSpace(string(enabled)) == "1" {
+		glog.V(4).Infof("LIO backstore %s already exists", device)
+		return device, nil
+	}
+
+	if err := t.fs.MkdirAll(device); err != nil {
+		return "", err
+	}
+	if err := t.fs.WriteAttribute(filepath.Join(device, "control"), control); err != nil {
+		return "", err
+	}
+	if err := t.fs.WriteAttribute(filepath.Join(device, "udev_path"), e.Path); err != nil {
+		return "", err
+	}
+	if err := t.fs.WriteAttribute(filepath.Join(device, "enable"), "1"); err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// setACLs maps the LUN of e to each of its initiators, or lets any initiator
+// log in when open is true. Initiators have to authenticate with the CHAP
+// credentials of e, if it has any. Whether any initiator may log in and
+// authentication are set for the whole TPG, so they are only set while it
+// has no other LUN than that of e: the volumes sharing a target share these
+// settings.
+func (t *lioTarget) setACLs(e *export, open bool) error {
+	tpg := t.tpgPath(e.IQN)
+	shared, err := t.hasOtherLuns(e.IQN, e.Lun)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		if err := t.setTPGAttributes(e, open); err != nil {
+			return err
+		}
+	}
+
+	lunName := fmt.Sprintf("lun_%d", e.Lun)
+	for _, initiator := range e.Initiators {
+		mapped := filepath.Join(tpg, "acls", initiator, lunName)
+		if err := t.fs.MkdirAll(mapped); err != nil {
+			return fmt.Errorf("error creating LIO ACL for %q: %v", initiator, err)
+		}
+		if err := symlink(t.lunPath(e.IQN, e.Lun), filepath.Join(mapped, lioLunLink)); err != nil {
+			return err
+		}
+		if e.Chap != nil {
+			if err := t.writeChap(filepath.Join(tpg, "acls", initiator, "auth"), e.Chap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setTPGAttributes sets the TPG of e to let any initiator log in when open is
+// true, or only those with an ACL, and to require the CHAP credentials of e
+// if it has any.
+func (t *lioTarget) setTPGAttributes(e *export, open bool) error {
+	tpg := t.tpgPath(e.IQN)
+	attributes := map[string]string{
+		"generate_node_acls":      "0",
+		"demo_mode_write_protect": "1",
+		"cache_dynamic_acls":      "0",
+	}
+	if open {
+		attributes = map[string]string{
+			"generate_node_acls":      "1",
+			"demo_mode_write_protect": "0",
+			"cache_dynamic_acls":      "1",
+		}
+	}
+	attributes["authentication"] = "0"
+	if e.Chap != nil {
+		attributes["authentication"] = "1"
+	}
+	for name, value := range attributes {
+		if err := t.fs.WriteAttribute(filepath.Join(tpg, "attrib", name), value); err != nil {
+			return err
+		}
+	}
+
+	if open && e.Chap != nil {
+		return t.writeChap(filepath.Join(tpg, "auth"), e.Chap)
+	}
+	return nil
+}
+
+// hasOtherLuns returns true if the target with the given IQN has LUNs other
+// than lun.
+func (t *lioTarget) hasOtherLuns(iqn string, lun int32) (bool, error) {
+	luns, err := ioutil.ReadDir(filepath.Join(t.tpgPath(iqn), "lun"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, entry := range luns {
+		if entry.Name() != fmt.Sprintf("lun_%d", lun) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeChap sets CHAP credentials in the given auth group of a TPG or ACL.
+func (t *lioTarget) writeChap(auth string, chap *chapCredentials) error {
+	attributes := map[string]string{
+		"userid":   chap.Username,
+		"password": chap.Password,
+	}
+	if chap.MutualUsername != "" {
+		attributes["userid_mutual"] = chap.MutualUsername
+		attributes["password_mutual"] = chap.MutualPassword
+	}
+	for name, value := range attributes {
+		if err := t.fs.WriteAttribute(filepath.Join(auth, name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLun removes a LUN and its mappings from a target.
+func (t *lioTarget) removeLun(iqn string, lun int32) error {
+	acls, err := ioutil.ReadDir(filepath.Join(t.tpgPath(iqn), "acls"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, acl := range acls {
+		if err := t.removeMappedLun(iqn, acl.Name(), lun); err != nil {
+			return err
+		}
+	}
+
+	lunPath := t.lunPath(iqn, lun)
+	if err := removeLinks(lunPath); err != nil {
+		return err
+	}
+	return t.fs.RemoveGroup(lunPath)
+}
+
+// removeMappedLun removes the mapping of a LUN from the ACL of an initiator,
+// and the ACL itself once it maps no LUN anymore.
+func (t *lioTarget) removeMappedLun(iqn, initiator string, lun int32) error {
+	aclPath := filepath.Join(t.tpgPath(iqn), "acls", initiator)
+	mapped := filepath.Join(aclPath, fmt.Sprintf("lun_%d", lun))
+	if err := removeLinks(mapped); err != nil {
+		return err
+	}
+	if err := t.fs.RemoveGroup(mapped); err != nil {
+		return err
+	}
+	if !hasLuns(aclPath) {
+		return t.fs.RemoveGroup(aclPath)
+	}
+	return nil
+}
+
+// removeTarget removes a target that has no LUNs left.
+func (t *lioTarget) removeTarget(iqn string) error {
+	tpg := t.tpgPath(iqn)
+	if err := t.fs.WriteAttribute(filepath.Join(tpg, "enable"), "0"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range []string{"acls", "np"} {
+		entries, err := ioutil.ReadDir(filepath.Join(tpg, dir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if err := t.fs.RemoveGroup(filepath.Join(tpg, dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := t.fs.RemoveGroup(tpg); err != nil {
+		return err
+	}
+	return t.fs.RemoveGroup(filepath.Join(t.root, "iscsi", iqn))
+}
+
+func (t *lioTarget) tpgPath(iqn string) string {
+	return filepath.Join(t.root, "iscsi", iqn, "tpgt_1")
+}
+
+func (t *lioTarget) lunPath(iqn string, lun int32) string {
+	return filepath.Join(t.tpgPath(iqn), "lun", fmt.Sprintf("lun_%d", lun))
+}
+
+// hasLuns returns true if the given ACL directory maps any LUN.
+func hasLuns(acl string) bool {
+	entries, _ := ioutil.ReadDir(acl)
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "lun_") {
+			return true
+		}
+	}
+	return false
+}
+
+// symlink creates a symlink unless one exists already.
+func symlink(target, link string) error {
+	if _, err := os.Lstat(link); err == nil {
+		return nil
+	}
+	return os.Symlink(target, link)
+}
+
+// removeLinks removes all symlinks in the given directory.
+func removeLinks(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newLIODriver(config ProvisionerConfig) (Driver, error) {
+	return newLocalDriver("lio", newLIOTarget(config.LIOConfigfsRoot), true, config)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeConfigfs stands in for configfs in a temporary directory tree. Plain
+// directories lack the attributes and default groups configfs creates with
+// each group, so the directories of attributes are created when they are
+// written and groups are removed with their contents, as long as no symlinks
+// are left in them.
+type fakeConfigfs struct{}
+
+func (fakeConfigfs) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (fakeConfigfs) WriteAttribute(path, value string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+func (fakeConfigfs) RemoveGroup(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	var links []string
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, p)
+		}
+		return nil
+	})
+	if len(links) > 0 {
+		return fmt.Errorf("cannot remove group %s, it has symlinks: %v", path, links)
+	}
+	return os.RemoveAll(path)
+}
+
+const (
+	testTargetIQN    = "iqn.2016-12.org.example:target"
+	testInitiatorIQN = "iqn.2016-12.org.example:node1"
+	testOtherIQN     = "iqn.2016-12.org.example:node2"
+)
+
+func newTestLIOTarget(t *testing.T) (*lioTarget, func()) {
+	root, err := ioutil.TempDir("", "lio-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lioTarget{root: root, fs: fakeConfigfs{}}, func() { os.RemoveAll(root) }
+}
+
+func readAttribute(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading attribute: %v", err)
+	}
+	return string(data)
+}
+
+func checkAttribute(t *testing.T, path, want string) {
+	if got := readAttribute(t, path); got != want {
+		t.Errorf("%s is %q, expected %q", path, got, want)
+	}
+}
+
+func checkLink(t *testing.T, link, want string) {
+	got, err := os.Readlink(link)
+	if err != nil {
+		t.Errorf("error reading link: %v", err)
+		return
+	}
+	if got != want {
+		t.Errorf("%s points to %s, expected %s", link, got, want)
+	}
+}
+
+func checkNotExist(t *testing.T, path string) {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("%s exists, expected it to be removed", path)
+	}
+}
+
+func testBlockExport(lun int32) *export {
+	return &export{
+		IQN:        testTargetIQN,
+		Name:       fmt.Sprintf("pvc-%d", lun),
+		Path:       fmt.Sprintf("/dev/vg0/pvc-%d", lun),
+		Lun:        lun,
+		Portals:    []string{"192.168.43.65"},
+		Initiators: []string{testInitiatorIQN},
+		ACL:        true,
+	}
+}
+
+func TestLIOExportBlock(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := testBlockExport(0)
+	e.Chap = &chapCredentials{Username: "user", Password: "password"}
+
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	device := filepath.Join(target.root, "core", lioBlockHBA, "pvc-0")
+	checkAttribute(t, filepath.Join(device, "control"), "udev_path=/dev/vg0/pvc-0")
+	checkAttribute(t, filepath.Join(device, "enable"), "1")
+
+	tpg := target.tpgPath(testTargetIQN)
+	lun := target.lunPath(testTargetIQN, 0)
+	checkLink(t, filepath.Join(lun, lioLunLink), device)
+	if _, err := os.Stat(filepath.Join(tpg, "np", "192.168.43.65:3260")); err != nil {
+		t.Errorf("portal not created: %v", err)
+	}
+	checkLink(t, filepath.Join(tpg, "acls", testInitiatorIQN, "lun_0", lioLunLink), lun)
+	checkAttribute(t, filepath.Join(tpg, "attrib", "generate_node_acls"), "0")
+	checkAttribute(t, filepath.Join(tpg, "attrib", "authentication"), "1")
+	checkAttribute(t, filepath.Join(tpg, "acls", testInitiatorIQN, "auth", "userid"), "user")
+	checkAttribute(t, filepath.Join(tpg, "acls", testInitiatorIQN, "auth", "password"), "password")
+	checkAttribute(t, filepath.Join(tpg, "enable"), "1")
+
+	// Exporting again changes nothing.
+	if err := target.Export(e); err != nil {
+		t.Errorf("second Export failed: %v", err)
+	}
+}
+
+func TestLIOExportOpen(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := testBlockExport(0)
+	e.Initiators = nil
+	e.ACL = false
+	e.Chap = &chapCredentials{Username: "user", Password: "password", MutualUsername: "target", MutualPassword: "secret"}
+
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	tpg := target.tpgPath(testTargetIQN)
+	checkAttribute(t, filepath.Join(tpg, "attrib", "generate_node_acls"), "1")
+	checkAttribute(t, filepath.Join(tpg, "attrib", "demo_mode_write_protect"), "0")
+	checkAttribute(t, filepath.Join(tpg, "auth", "userid"), "user")
+	checkAttribute(t, filepath.Join(tpg, "auth", "userid_mutual"), "target")
+	checkAttribute(t, filepath.Join(tpg, "auth", "password_mutual"), "secret")
+}
+
+func TestLIOExportFileIO(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := &export{IQN: testTargetIQN, Name: "pvc-1", Path: "/var/lib/iscsi/pvc-1.img", FileIO: true}
+
+	if err := target.Export(e); err == nil {
+		t.Errorf("Export of a fileio backstore without size succeeded")
+	}
+	e.Size = 1 << 20
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	device := filepath.Join(target.root, "core", lioFileIOHBA, "pvc-1")
+	checkAttribute(t, filepath.Join(device, "control"), "fd_dev_name=/var/lib/iscsi/pvc-1.img,fd_dev_size=1048576")
+	checkAttribute(t, filepath.Join(device, "udev_path"), "/var/lib/iscsi/pvc-1.img")
+
+	if err := target.CanResize(e); err == nil || isTemporary(err) {
+		t.Errorf("got %v for a fileio backstore, expected a permanent error", err)
+	}
+}
+
+func TestLIOCanResizeBlock(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := testBlockExport(0)
+
+	if err := target.CanResize(e); err == nil {
+		t.Errorf("CanResize succeeded for a backstore that does not exist")
+	}
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if err := target.CanResize(e); err != nil {
+		t.Errorf("CanResize failed for a block backstore: %v", err)
+	}
+}
+
+func TestLIOUnexport(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := testBlockExport(0)
+
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if err := target.Unexport(e); err != nil {
+		t.Fatalf("Unexport failed: %v", err)
+	}
+	checkNotExist(t, filepath.Join(target.root, "iscsi", testTargetIQN))
+	checkNotExist(t, filepath.Join(target.root, "core", lioBlockHBA, "pvc-0"))
+
+	// Unexporting again is not an error.
+	if err := target.Unexport(e); err != nil {
+		t.Errorf("second Unexport failed: %v", err)
+	}
+}
+
+func TestLIOSharedTarget(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	first, second := testBlockExport(0), testBlockExport(1)
+	second.Initiators = []string{testInitiatorIQN, testOtherIQN}
+
+	if err := target.Export(first); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	// The TPG attributes are only set for the first LUN.
+	attribute := filepath.Join(target.tpgPath(testTargetIQN), "attrib", "cache_dynamic_acls")
+	if err := ioutil.WriteFile(attribute, []byte("admin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Export(second); err != nil {
+		t.Fatalf("Export of a second LUN failed: %v", err)
+	}
+	checkAttribute(t, attribute, "admin")
+
+	// Removing the first LUN keeps the target and the ACL mapping the second.
+	if err := target.Unexport(first); err != nil {
+		t.Fatalf("Unexport failed: %v", err)
+	}
+	acls := filepath.Join(target.tpgPath(testTargetIQN), "acls")
+	checkNotExist(t, filepath.Join(acls, testInitiatorIQN, "lun_0"))
+	checkLink(t, filepath.Join(acls, testInitiatorIQN, "lun_1", lioLunLink), target.lunPath(testTargetIQN, 1))
+	checkAttribute(t, filepath.Join(target.tpgPath(testTargetIQN), "enable"), "1")
+
+	if err := target.Unexport(second); err != nil {
+		t.Fatalf("Unexport of the last LUN failed: %v", err)
+	}
+	checkNotExist(t, filepath.Join(target.root, "iscsi", testTargetIQN))
+}
+
+func TestLIOSetInitiators(t *testing.T) {
+	target, cleanup := newTestLIOTarget(t)
+	defer cleanup()
+	e := testBlockExport(0)
+
+	if err := target.SetInitiators(e); err == nil {
+		t.Errorf("SetInitiators succeeded for a LUN that does not exist")
+	}
+	if err := target.Export(e); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	e.Initiators = []string{testOtherIQN}
+	if err := target.SetInitiators(e); err != nil {
+		t.Fatalf("SetInitiators failed: %v", err)
+	}
+	acls := filepath.Join(target.tpgPath(testTargetIQN), "acls")
+	checkNotExist(t, filepath.Join(acls, testInitiatorIQN))
+	checkLink(t, filepath.Join(acls, testOtherIQN, "lun_0", lioLunLink), target.lunPath(testTargetIQN, 0))
+	if entries, _ := ioutil.ReadDir(acls); len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("got ACLs %s, expected only %s", strings.Join(names, ", "), testOtherIQN)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// StorageClass parameters of the execmodes driving a target on the host the
+// provisioner runs on.
+const (
+	// Backstore type, "fileio" (default) or "block".
+	localParamBackstore = "backstore"
+	// Block device to export with the block backstore. "{pvName}" is
+	// replaced with the name of the PV.
+	localParamDevicePath = "devicePath"
+)
+
+const (
+	backstoreFileIO = "fileio"
+	backstoreBlock  = "block"
+)
+
+// fileOwner is stored next to each image file created for a fileio
+// backstore. Image files without one, or with one of another provisioner, are
+// never deleted.
+type fileOwner struct {
+	Provisioner string `json:"provisioner"`
+	PVName      string `json:"pvName"`
+	SizeBytes   int64  `json:"sizeBytes"`
+}
+
+// localDriver provisions volumes as image files or existing block devices
+// exported by a target layer on the host the provisioner runs on.
+type localDriver struct {
+	targetExporter
+	fileIODir   string
+	provisioner string
+	// block is true if volumes can be existing block devices, volumes are
+	// always image files otherwise.
+	block bool
+}
+
+func newLocalDriver(execMode string, target targetLayer, block bool, config ProvisionerConfig) (*localDriver, error) {
+	exporter, err := newTargetExporter(execMode, target, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.FileIODir == "" {
+		return nil, fmt.Errorf("fileio-dir must be set in %s execmode", execMode)
+	}
+	return &localDriver{
+		targetExporter: exporter,
+		fileIODir:      config.FileIODir,
+		provisioner:    config.ProvisionerName,
+		block:          block,
+	}, nil
+}
+
+func (d *localDriver) ValidateParameters(parameters map[string]string) error {
+	if !d.block {
+		return checkParameters(parameters)
+	}
+	if err := checkParameters(parameters, localParamBackstore, localParamDevicePath); err != nil {
+		return err
+	}
+	switch backstore := parameters[localParamBackstore]; backstore {
+	case "", backstoreFileIO:
+	case backstoreBlock:
+		if parameters[localParamDevicePath] == "" {
+			return fmt.Errorf("%s must be set for %s backstore", localParamDevicePath, backstoreBlock)
+		}
+	default:
+		return fmt.Errorf("unknown %s %q", localParamBackstore, backstore)
+	}
+	return nil
+}
+
+// RoundSize rounds the size of fileio backstores up to whole blocks. Block
+// backstores have the size of their device.
+func (d *localDriver) RoundSize(size int64, parameters map[string]string) (int64, error) {
+	if backstore := parameters[localParamBackstore]; !d.block || backstore == "" || backstore == backstoreFileIO {
+		return roundUp(size, fileIOBlockSize), nil
+	}
+	return size, nil
+}
+
+func (d *localDriver) Provision(options VolumeOptions) (*Volume, error) {
+	name := options.PVName
+	e := &export{Name: name}
+	backstore := options.Parameters[localParamBackstore]
+	if !d.block {
+		backstore = backstoreFileIO
+	}
+	switch backstore {
+	case "", backstoreFileIO:
+		// Block backstores have the size of their device.
+		e.FileIO = true
+		e.Size = options.Capacity.Value()
+		e.Path = d.imagePath(name)
+		if err := d.createImage(name, e.Size); err != nil {
+			return nil, err
+		}
+	case backstoreBlock:
+		devicePath := options.Parameters[localParamDevicePath]
+		if devicePath == "" {
+			return nil, fmt.Errorf("%s must be set for %s backstore", localParamDevicePath, backstoreBlock)
+		}
+		e.Path = strings.Replace(devicePath, "{pvName}", name, -1)
+	default:
+		return nil, fmt.Errorf("unknown %s %q", localParamBackstore, backstore)
+	}
+
+	return d.exportVolume(e, options, name, func() error {
+		return d.removeImage(name)
+	})
+}
+
+func (d *localDriver) Delete(volume *v1.PersistentVolume) error {
+	if volume.Spec.ISCSI == nil {
+		return fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	name := getBackendID(volume)
+	if err := d.unexportVolume(volume, name); err != nil {
+		return err
+	}
+	return d.removeImage(name)
+}
+
+// Usage returns the bytes really allocated to the image file of a volume, or
+// -1 for volumes exporting a block device.
+func (d *localDriver) Usage(volume *v1.PersistentVolume) (int64, error) {
+	info, err := os.Stat(d.imagePath(getBackendID(volume)))
+	if err != nil {
+		if os.IsNotExist(err) && d.block {
+			return -1, nil
+		}
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot get allocated blocks of %s", info.Name())
+	}
+	return stat.Blocks * 512, nil
+}
+
+// createImage creates the image file of a volume unless it exists.
+func (d *localDriver) createImage(name string, size int64) error {
+	owned, err := d.owned(name)
+	if err != nil {
+		return err
+	}
+	if owned {
+		return nil
+	}
+	if _, err := os.Stat(d.imagePath(name)); err == nil {
+		return fmt.Errorf("file %s exists but was not created by this provisioner", d.imagePath(name))
+	}
+	// Record ownership first so that a file left behind by a failed
+	// attempt is still ours.
+	if err := d.setOwner(name, size); err != nil {
+		return err
+	}
+	return createSparseFile(d.imagePath(name), size)
+}
+
+// removeImage deletes the image file of a volume if it is ours.
+func (d *localDriver) removeImage(name string) error {
+	owned, err := d.owned(name)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		if _, err := os.Stat(d.imagePath(name)); err == nil {
+			glog.Warningf("not deleting file %s, it was not created by this provisioner", d.imagePath(name))
+		}
+		return nil
+	}
+	if err := os.Remove(d.imagePath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(d.ownerPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// owned returns true if the image file of the given volume was created by
+// this provisioner.
+func (d *localDriver) owned(name string) (bool, error) {
+	data, err := ioutil.ReadFile(d.ownerPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	owner := fileOwner{}
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return false, fmt.Errorf("error decoding %s: %v", d.ownerPath(name), err)
+	}
+	return owner.Provisioner == d.provisioner && owner.PVName == name, nil
+}
+
+// setOwner records that the image file of the given volume is created by
+// this provisioner.
+func (d *localDriver) setOwner(name string, size int64) error {
+	data, err := json.Marshal(&fileOwner{Provisioner: d.provisioner, PVName: name, SizeBytes: size})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.fileIODir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ownerPath(name), data, 0600)
+}
+
+func (d *localDriver) imagePath(name string) string {
+	return filepath.Join(d.fileIODir, name+".img")
+}
+
+func (d *localDriver) ownerPath(name string) string {
+	return filepath.Join(d.fileIODir, name+".owner")
+}
+
+// createSparseFile creates a sparse file of the given size unless it exists.
+func createSparseFile(path string, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("cannot create file %s without a size", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			glog.V(4).Infof("file %s already exists", path)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLocalDriver(t *testing.T, block bool) (*localDriver, *fakeTarget, func()) {
+	dir, err := ioutil.TempDir("", "local-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, target := newTestTargetExporter()
+	driver := &localDriver{targetExporter: exporter, fileIODir: dir, provisioner: "iscsi-provisioner", block: block}
+	return driver, target, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalProvisionImage(t *testing.T) {
+	driver, target, cleanup := newTestLocalDriver(t, false)
+	defer cleanup()
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<20, nil))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	image := filepath.Join(driver.fileIODir, "pvc-1.img")
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatalf("image not created: %v", err)
+	}
+	if info.Size() != 1<<20 {
+		t.Errorf("got image of %d bytes, expected 1048576", info.Size())
+	}
+	if owned, err := driver.owned("pvc-1"); err != nil || !owned {
+		t.Errorf("image is not owned: %v", err)
+	}
+	if e := target.lastExport(t); !e.FileIO || e.Path != image || e.Size != 1<<20 {
+		t.Errorf("unexpected export %+v", e)
+	}
+	if volume.BackendID != "pvc-1" || volume.Size.Value() != 1<<20 {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+
+	// Provisioning again reuses the image.
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1<<20, nil)); err != nil {
+		t.Errorf("second Provision failed: %v", err)
+	}
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	checkNotExist(t, image)
+	checkNotExist(t, filepath.Join(driver.fileIODir, "pvc-1.owner"))
+}
+
+func TestLocalForeignImage(t *testing.T) {
+	driver, _, cleanup := newTestLocalDriver(t, false)
+	defer cleanup()
+	image := filepath.Join(driver.fileIODir, "pvc-1.img")
+	if err := ioutil.WriteFile(image, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1<<20, nil)); err == nil {
+		t.Errorf("Provision succeeded over an image of someone else")
+	}
+	if err := driver.Delete(testISCSIVolume("pvc-1", "pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Errorf("image of someone else was deleted: %v", err)
+	}
+}
+
+func TestLocalProvisionBlock(t *testing.T) {
+	parameters := map[string]string{localParamBackstore: backstoreBlock, localParamDevicePath: "/dev/vg0/{pvName}"}
+	driver, target, cleanup := newTestLocalDriver(t, true)
+	defer cleanup()
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<20, parameters))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if e := target.lastExport(t); e.FileIO || e.Path != "/dev/vg0/pvc-1" {
+		t.Errorf("unexpected export %+v", e)
+	}
+	if !volume.Size.IsZero() {
+		t.Errorf("got size %s for a block device", volume.Size.String())
+	}
+	if usage, err := driver.Usage(testISCSIVolume("pvc-1", "pvc-1")); err != nil || usage != -1 {
+		t.Errorf("got usage %d and error %v for a block device, expected -1", usage, err)
+	}
+}
+
+func TestLocalValidateParameters(t *testing.T) {
+	parameters := map[string]string{localParamBackstore: backstoreBlock, localParamDevicePath: "/dev/sdb"}
+	block, _, cleanup := newTestLocalDriver(t, true)
+	defer cleanup()
+	if err := block.ValidateParameters(parameters); err != nil {
+		t.Errorf("ValidateParameters failed: %v", err)
+	}
+
+	// The file execmode only creates image files.
+	file, _, cleanup := newTestLocalDriver(t, false)
+	defer cleanup()
+	if err := file.ValidateParameters(parameters); err == nil {
+		t.Errorf("ValidateParameters accepted a block backstore")
+	}
+}
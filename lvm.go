@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func init() {
+	registerDriver("lvm", newLVMDriver)
+}
+
+// StorageClass parameters of the lvm execmode.
+const (
+	// Volume group to create logical volumes in, required.
+	lvmParamVolumeGroup = "volumeGroup"
+	// Thin pool in the volume group to create thin volumes in. Volumes are
+	// fully allocated if not set.
+	lvmParamThinPool = "thinPool"
+)
+
+// Prefix of the names of logical volumes in the trash.
+const lvmTrashPrefix = "trash-"
+
+// lvm creates and removes logical volumes with the LVM command line tools.
+type lvm struct {
+	runner commandRunner
+}
+
+// createVolume creates a logical volume of at least size bytes, thin if pool
+// is not empty.
+func (l *lvm) createVolume(vg, pool, name string, size int64) error {
+	if pool != "" {
+		_, err := l.runner.Run("lvcreate", "--virtualsize", fmt.Sprintf("%db", size), "--thin", vg+"/"+pool, "--name", name)
+		return err
+	}
+	_, err := l.runner.Run("lvcreate", "--size", fmt.Sprintf("%db", size), "--name", name, vg)
+	return err
+}
+
+// volumeSize returns the size of a logical volume in bytes, or -1 if it does
+// not exist.
+func (l *lvm) volumeSize(vg, name string) (int64, error) {
+	out, err := l.runner.Run("lvs", "--noheadings", "--nosuffix", "--units", "b", "--separator", ":", "--options", "lv_name,lv_size", vg)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 2 || fields[0] != name {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse size of logical volume %s/%s: %v", vg, name, err)
+		}
+		return size, nil
+	}
+	return -1, nil
+}
+
+// extendVolume grows a logical volume to at least size bytes.
+func (l *lvm) extendVolume(vg, name string, size int64) error {
+	_, err := l.runner.Run("lvextend", "--size", fmt.Sprintf("%db", size), vg+"/"+name)
+	return err
+}
+
+// createSnapshot creates a snapshot of a logical volume with room for the
+// given number of changed bytes.
+func (l *lvm) createSnapshot(vg, origin, name string, size int64) error {
+	_, err := l.runner.Run("lvcreate", "--snapshot", "--size", fmt.Sprintf("%db", size), "--name", name, vg+"/"+origin)
+	return err
+}
+
+// creationTime returns the creation time of a logical volume.
+func (l *lvm) creationTime(vg, name string) (time.Time, error) {
+	out, err := l.runner.Run("lvs", "--noheadings", "--options", "lv_time", vg+"/"+name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	created, err := time.Parse("2006-01-02 15:04:05 -0700", strings.TrimSpace(string(out)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse creation time of logical volume %s/%s: %v", vg, name, err)
+	}
+	return created, nil
+}
+
+// snapshots returns the names of the snapshots of a logical volume.
+func (l *lvm) snapshots(vg, origin string) ([]string, error) {
+	out, err := l.runner.Run("lvs", "--noheadings", "--separator", ":", "--options", "lv_name,origin", vg)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) == 2 && fields[1] == origin {
+			names = append(names, fields[0])
+		}
+	}
+	return names, nil
+}
+
+// renameVolume renames a logical volume.
+func (l *lvm) renameVolume(vg, name, newName string) error {
+	_, err := l.runner.Run("lvrename", vg, name, newName)
+	return err
+}
+
+// copyVolume copies the data of a block device to another one at least as
+// large. If sparse is true blocks of zeroes are skipped rather than written,
+// which keeps thin targets, that read as zeroes where nothing was written,
+// from being fully allocated.
+func (l *lvm) copyVolume(source, target string, sparse bool) error {
+	conv := "conv=fsync"
+	if sparse {
+		conv += ",sparse"
+	}
+	_, err := l.runner.Run("dd", "if="+source, "of="+target, "bs=1M", "oflag=direct", conv)
+	return err
+}
+
+// extentSize returns the extent size of a volume group in bytes.
+func (l *lvm) extentSize(vg string) (int64, error) {
+	out, err := l.runner.Run("vgs", "--noheadings", "--nosuffix", "--units", "b", "--options", "vg_extent_size", vg)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("cannot parse extent size of volume group %s: %q", vg, strings.TrimSpace(string(out)))
+	}
+	return size, nil
+}
+
+// removeVolume removes a logical volume.
+func (l *lvm) removeVolume(vg, name string) error {
+	_, err := l.runner.Run("lvremove", "--force", vg+"/"+name)
+	return err
+}
+
+// lvmDriver provisions volumes as logical volumes exported by a target layer.
+type lvmDriver struct {
+	targetExporter
+	lvm *lvm
+}
+
+func newLVMDriver(config ProvisionerConfig) (Driver, error) {
+	target, err := newTargetLayer(config)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newTargetExporter("lvm", target, config)
+	if err != nil {
+		return nil, err
+	}
+	return &lvmDriver{
+		targetExporter: exporter,
+		lvm:            &lvm{runner: execRunner{}},
+	}, nil
+}
+
+func (d *lvmDriver) ValidateParameters(parameters map[string]string) error {
+	if err := checkParameters(parameters, lvmParamVolumeGroup, lvmParamThinPool); err != nil {
+		return err
+	}
+	if parameters[lvmParamVolumeGroup] == "" {
+		return fmt.Errorf("%s must be set in lvm execmode", lvmParamVolumeGroup)
+	}
+	return nil
+}
+
+// RoundSize rounds size up to whole extents of the volume group.
+func (d *lvmDriver) RoundSize(size int64, parameters map[string]string) (int64, error) {
+	vg := parameters[lvmParamVolumeGroup]
+	if vg == "" {
+		return 0, fmt.Errorf("%s must be set in lvm execmode", lvmParamVolumeGroup)
+	}
+	extentSize, err := d.lvm.extentSize(vg)
+	if err != nil {
+		return 0, err
+	}
+	return roundUp(size, extentSize), nil
+}
+
+func (d *lvmDriver) Provision(options VolumeOptions) (*Volume, error) {
+	vg := options.Parameters[lvmParamVolumeGroup]
+	if vg == "" {
+		return nil, fmt.Errorf("%s must be set in lvm execmode", lvmParamVolumeGroup)
+	}
+	name := options.PVName
+
+	size, err := ensureVolume(fmt.Sprintf("logical volume %s/%s", vg, name), func() (int64, error) {
+		return d.lvm.volumeSize(vg, name)
+	}, func() error {
+		return d.lvm.createVolume(vg, options.Parameters[lvmParamThinPool], name, options.Capacity.Value())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.export(vg, name, size, options, true)
+}
+
+// Clone creates a logical volume with a copy of the data of a snapshot or of
+// another logical volume. Volumes are copied from a temporary snapshot so that
+// the copy is consistent even if the volume is in use.
+func (d *lvmDriver) Clone(options VolumeOptions, source *CloneSource) (*Volume, error) {
+	vg := options.Parameters[lvmParamVolumeGroup]
+	if vg == "" {
+		return nil, fmt.Errorf("%s must be set in lvm execmode", lvmParamVolumeGroup)
+	}
+	name := options.PVName
+
+	// A volume left by an interrupted clone may be incomplete, start over.
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		glog.V(3).Infof("removing logical volume %s/%s left by a previous clone", vg, name)
+		// The previous clone may have exported it before it failed.
+		if err := d.unexportProvisioned(name, options); err != nil {
+			return nil, err
+		}
+		if err := d.lvm.removeVolume(vg, name); err != nil {
+			return nil, err
+		}
+	}
+
+	id := source.SnapshotID
+	if id == "" {
+		sourceVG, origin, err := parseLVMBackendID(source.BackendID)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := name + "-source"
+		if size, err := d.lvm.volumeSize(sourceVG, snapshot); err != nil {
+			return nil, err
+		} else if size < 0 {
+			if err := d.lvm.createSnapshot(sourceVG, origin, snapshot, source.SizeBytes); err != nil {
+				return nil, err
+			}
+		}
+		defer func() {
+			if err := d.lvm.removeVolume(sourceVG, snapshot); err != nil {
+				glog.Errorf("error removing temporary snapshot %s/%s: %v", sourceVG, snapshot, err)
+			}
+		}()
+		id = sourceVG + "/" + snapshot
+	}
+	if _, _, err := parseLVMBackendID(id); err != nil {
+		return nil, err
+	}
+
+	pool := options.Parameters[lvmParamThinPool]
+	if err := d.lvm.createVolume(vg, pool, name, options.Capacity.Value()); err != nil {
+		return nil, err
+	}
+	if err := d.lvm.copyVolume("/dev/"+id, fmt.Sprintf("/dev/%s/%s", vg, name), pool != ""); err != nil {
+		if cleanupErr := d.lvm.removeVolume(vg, name); cleanupErr != nil {
+			glog.Errorf("error removing logical volume %s/%s: %v", vg, name, cleanupErr)
+		}
+		return nil, err
+	}
+	if size, err = d.lvm.volumeSize(vg, name); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("logical volume %s/%s not found after creating it", vg, name)
+	}
+	return d.export(vg, name, size, options, true)
+}
+
+// export exports a logical volume with the given options. If that fails the
+// volume is removed if remove is true.
+func (d *lvmDriver) export(vg, name string, size int64, options VolumeOptions, remove bool) (*Volume, error) {
+	e := &export{
+		Name: name,
+		Path: fmt.Sprintf("/dev/%s/%s", vg, name),
+		Size: size,
+	}
+	var removeVolume func() error
+	if remove {
+		removeVolume = func() error {
+			return d.lvm.removeVolume(vg, name)
+		}
+	}
+	return d.exportVolume(e, options, vg+"/"+name, removeVolume)
+}
+
+func (d *lvmDriver) Delete(volume *v1.PersistentVolume) error {
+	if volume.Spec.ISCSI == nil {
+		return fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	vg, name, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return err
+	}
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return err
+	}
+	// lvremove would remove the snapshots too. The volume stays exported
+	// until they are deleted.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(vg, name, "deleted"); err != nil {
+			return err
+		}
+	}
+	if err = d.unexportVolume(volume, name); err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("logical volume %s/%s not found, assuming it is deleted", vg, name)
+		return nil
+	}
+	return d.lvm.removeVolume(vg, name)
+}
+
+// checkNoSnapshots returns a permanent error if a logical volume has
+// snapshots, which keep it from being deleted, trashed or wiped.
+func (d *lvmDriver) checkNoSnapshots(vg, name, operation string) error {
+	snapshots, err := d.lvm.snapshots(vg, name)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		return permanentError{fmt.Errorf("logical volume %s/%s cannot be %s, it has snapshots: %s. Delete its VolumeSnapshots first", vg, name, operation, strings.Join(snapshots, ", "))}
+	}
+	return nil
+}
+
+func (d *lvmDriver) Expand(volume *v1.PersistentVolume, size int64) (int64, error) {
+	if volume.Spec.ISCSI == nil {
+		return 0, fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	vg, name, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return 0, err
+	}
+	current, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return 0, err
+	}
+	if current < 0 {
+		return 0, fmt.Errorf("logical volume %s/%s not found", vg, name)
+	}
+	e := &export{
+		IQN:  volume.Spec.ISCSI.IQN,
+		Name: name,
+		Path: fmt.Sprintf("/dev/%s/%s", vg, name),
+		Lun:  volume.Spec.ISCSI.Lun,
+	}
+	// Don't grow volumes whose LUN would keep its old size.
+	if err := d.target.CanResize(e); err != nil {
+		return 0, err
+	}
+	if current < size {
+		if err := d.lvm.extendVolume(vg, name, size); err != nil {
+			return 0, err
+		}
+		if current, err = d.lvm.volumeSize(vg, name); err != nil {
+			return 0, err
+		}
+	}
+	e.Size = current
+	return current, d.target.Resize(e)
+}
+
+// Snapshot creates a snapshot logical volume with as much room for changes
+// as the origin has, so that it cannot fill up.
+func (d *lvmDriver) Snapshot(volume *v1.PersistentVolume, name string) (*Snapshot, error) {
+	vg, origin, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return nil, err
+	}
+	size, err := d.lvm.volumeSize(vg, origin)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("logical volume %s/%s not found", vg, origin)
+	}
+	existing, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing < 0 {
+		if err := d.lvm.createSnapshot(vg, origin, name, size); err != nil {
+			return nil, err
+		}
+	}
+	created, err := d.lvm.creationTime(vg, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{ID: vg + "/" + name, SizeBytes: size, CreationTime: created}, nil
+}
+
+func (d *lvmDriver) DeleteSnapshot(id string) error {
+	vg, name, err := parseLVMBackendID(id)
+	if err != nil {
+		return err
+	}
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("snapshot %s not found, assuming it is deleted", id)
+		return nil
+	}
+	return d.lvm.removeVolume(vg, name)
+}
+
+func (d *lvmDriver) ListSnapshots(volume *v1.PersistentVolume) (map[string]string, error) {
+	vg, origin, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.lvm.snapshots(vg, origin)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, name := range names {
+		ids[name] = vg + "/" + name
+	}
+	return ids, nil
+}
+
+// Trash renames the logical volume with a trash- prefix.
+func (d *lvmDriver) Trash(volume *v1.PersistentVolume) (string, error) {
+	if volume.Spec.ISCSI == nil {
+		return "", fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	vg, name, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return "", err
+	}
+	trashName := lvmTrashPrefix + name
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return "", err
+	}
+	// Purging the volume would remove the snapshots too.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(vg, name, "moved to the trash"); err != nil {
+			return "", err
+		}
+	}
+	if err = d.unexportVolume(volume, name); err != nil {
+		return "", err
+	}
+	if size >= 0 {
+		if err := d.lvm.renameVolume(vg, name, trashName); err != nil {
+			return "", err
+		}
+	} else {
+		glog.V(4).Infof("logical volume %s/%s not found, assuming it is in the trash", vg, name)
+	}
+	return vg + "/" + trashName, nil
+}
+
+func (d *lvmDriver) Restore(id string, options VolumeOptions) (*Volume, error) {
+	vg, trashName, err := parseLVMBackendID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(trashName, lvmTrashPrefix) {
+		return nil, fmt.Errorf("logical volume %s is not in the trash", id)
+	}
+	name := options.PVName
+
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		if size, err = d.lvm.volumeSize(vg, trashName); err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("logical volume %s not found in the trash", id)
+		}
+		if err := d.lvm.renameVolume(vg, trashName, name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Leave the volume for the next attempt rather than delete restored
+	// data.
+	return d.export(vg, name, size, options, false)
+}
+
+func (d *lvmDriver) Purge(id string) error {
+	vg, name, err := parseLVMBackendID(id)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(name, lvmTrashPrefix) {
+		return fmt.Errorf("logical volume %s is not in the trash", id)
+	}
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("logical volume %s not found, assuming it is purged", id)
+		return nil
+	}
+	return d.lvm.removeVolume(vg, name)
+}
+
+func (d *lvmDriver) CanWipe(policy string) bool {
+	return policy == wipePolicyDiscard || policy == wipePolicyZeroFill
+}
+
+// Wipe removes the volume from its target, so that no initiator writes to
+// it once it is wiped, and wipes it.
+func (d *lvmDriver) Wipe(volume *v1.PersistentVolume, policy string) error {
+	vg, name, err := parseLVMBackendID(getBackendID(volume))
+	if err != nil {
+		return err
+	}
+	size, err := d.lvm.volumeSize(vg, name)
+	if err != nil {
+		return err
+	}
+	// Snapshots get a copy of every block overwritten by wiping.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(vg, name, "wiped"); err != nil {
+			return err
+		}
+	}
+	if err = d.unexportVolume(volume, name); err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("logical volume %s/%s not found, nothing to wipe", vg, name)
+		return nil
+	}
+	return wipeDevice(d.lvm.runner, fmt.Sprintf("/dev/%s/%s", vg, name), policy)
+}
+
+// parseLVMBackendID splits a <volume group>/<logical volume> backend ID.
+func parseLVMBackendID(id string) (string, string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid lvm backend ID %q", id)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Prefix of the lvs commands listing the sizes of logical volumes.
+const testLVSizes = "lvs --noheadings --nosuffix"
+
+func newTestLVMDriver(runner *fakeRunner) (*lvmDriver, *fakeTarget) {
+	exporter, target := newTestTargetExporter()
+	return &lvmDriver{targetExporter: exporter, lvm: &lvm{runner: runner}}, target
+}
+
+func TestLVMProvision(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testLVSizes, "  other:4194304\n")
+	runner.respond(testLVSizes, "  other:4194304\n  pvc-1:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0"}))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	runner.checkCommands(t, "lvcreate", "lvcreate --size 1073741824b --name pvc-1 vg0")
+	if e := target.lastExport(t); e.Path != "/dev/vg0/pvc-1" || e.Name != "pvc-1" || e.FileIO {
+		t.Errorf("unexpected export %+v", e)
+	}
+	if volume.BackendID != "vg0/pvc-1" || volume.Size.Value() != 1<<30 || volume.IQN != testIQNPrefix+":pvc-1" {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+}
+
+func TestLVMProvisionExisting(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testLVSizes, "  pvc-1:1077936128\n")
+	driver, _ := newTestLVMDriver(runner)
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0"}))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	runner.checkCommands(t, "lvcreate")
+	if volume.Size.Value() != 1077936128 {
+		t.Errorf("got size %d, expected the size of the existing volume", volume.Size.Value())
+	}
+}
+
+func TestLVMProvisionThin(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testLVSizes, "")
+	runner.respond(testLVSizes, "  pool0:10737418240\n  pvc-1:1073741824\n")
+	driver, _ := newTestLVMDriver(runner)
+
+	_, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0", lvmParamThinPool: "pool0"}))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	runner.checkCommands(t, "lvcreate", "lvcreate --virtualsize 1073741824b --thin vg0/pool0 --name pvc-1")
+}
+
+func TestLVMProvisionExportFailure(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testLVSizes, "")
+	runner.respond(testLVSizes, "  pvc-1:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+	target.exportErr = errors.New("target is down")
+
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0"})); err == nil {
+		t.Fatalf("Provision succeeded although the export failed")
+	}
+	runner.checkCommands(t, "lvremove", "lvremove --force vg0/pvc-1")
+}
+
+func TestLVMProvisionNotCreated(t *testing.T) {
+	runner := &fakeRunner{}
+	driver, _ := newTestLVMDriver(runner)
+
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0"})); err == nil {
+		t.Errorf("Provision succeeded although the logical volume was not found after creating it")
+	}
+}
+
+func TestLVMRoundSize(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("vgs", "  4194304\n")
+	driver, _ := newTestLVMDriver(runner)
+	parameters := map[string]string{lvmParamVolumeGroup: "vg0"}
+
+	tests := []struct {
+		size, want int64
+	}{
+		{size: 1, want: 4 << 20},
+		{size: 4 << 20, want: 4 << 20},
+		{size: 1<<30 + 1, want: 1<<30 + 4<<20},
+	}
+	for _, test := range tests {
+		size, err := driver.RoundSize(test.size, parameters)
+		if err != nil {
+			t.Fatalf("RoundSize failed: %v", err)
+		}
+		if size != test.want {
+			t.Errorf("rounded %d to %d, expected %d", test.size, size, test.want)
+		}
+	}
+	runner.checkCommands(t, "vgs",
+		"vgs --noheadings --nosuffix --units b --options vg_extent_size vg0",
+		"vgs --noheadings --nosuffix --units b --options vg_extent_size vg0",
+		"vgs --noheadings --nosuffix --units b --options vg_extent_size vg0",
+	)
+}
+
+func TestLVMRoundSizeInvalidExtentSize(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("vgs", "  Volume group \"vg0\" not found\n")
+	driver, _ := newTestLVMDriver(runner)
+
+	if _, err := driver.RoundSize(1<<30, map[string]string{lvmParamVolumeGroup: "vg0"}); err == nil {
+		t.Errorf("RoundSize succeeded without an extent size")
+	}
+}
+
+func TestLVMDelete(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testLVSizes, "  pvc-1:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "vg0/pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if len(target.unexported) != 1 || target.unexported[0].Name != "pvc-1" {
+		t.Errorf("got unexports %+v, expected one of pvc-1", target.unexported)
+	}
+	runner.checkCommands(t, "lvremove", "lvremove --force vg0/pvc-1")
+}
+
+func TestLVMDeleteNotFound(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testLVSizes, "  other:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "vg0/pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if len(target.unexported) != 1 {
+		t.Errorf("got %d unexports, expected 1", len(target.unexported))
+	}
+	runner.checkCommands(t, "lvremove")
+}
+
+func TestLVMDeleteWithSnapshots(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testLVSizes, "  pvc-1:1073741824\n")
+	runner.respond("lvs --noheadings --separator : --options lv_name,origin vg0", "  pvc-1:\n  snapshot-1234:pvc-1\n")
+	driver, target := newTestLVMDriver(runner)
+
+	err := driver.Delete(testISCSIVolume("pvc-1", "vg0/pvc-1"))
+	if err == nil {
+		t.Fatalf("Delete succeeded for a logical volume with snapshots")
+	}
+	if isTemporary(err) {
+		t.Errorf("got temporary error %v, expected a permanent one", err)
+	}
+	// The volume stays exported while it is kept.
+	if len(target.unexported) != 0 {
+		t.Errorf("got unexports %+v, expected none", target.unexported)
+	}
+	runner.checkCommands(t, "lvremove")
+}
+
+func TestLVMDeleteInvalidBackendID(t *testing.T) {
+	driver, _ := newTestLVMDriver(&fakeRunner{})
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "pvc-1")); err == nil {
+		t.Errorf("Delete succeeded for an invalid backend ID")
+	}
+}
+
+func TestLVMCloneLeftover(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testLVSizes, "  pvc-2:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+
+	_, err := driver.Clone(testVolumeOptions("pvc-2", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0", lvmParamThinPool: "pool0"}), &CloneSource{SnapshotID: "vg0/snapshot-1234"})
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	// The volume of the previous attempt is unexported before it is removed.
+	if len(target.unexported) != 1 || target.unexported[0].IQN != testIQNPrefix+":pvc-2" || target.unexported[0].Lun != 1 {
+		t.Errorf("got unexports %+v, expected one of the leftover volume", target.unexported)
+	}
+	runner.checkCommands(t, "lvremove", "lvremove --force vg0/pvc-2")
+	// Thin volumes are copied sparsely.
+	runner.checkCommands(t, "dd", "dd if=/dev/vg0/snapshot-1234 of=/dev/vg0/pvc-2 bs=1M oflag=direct conv=fsync,sparse")
+}
+
+func TestLVMCloneThick(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testLVSizes, "")
+	runner.respond(testLVSizes, "  pvc-2:1073741824\n")
+	driver, target := newTestLVMDriver(runner)
+
+	_, err := driver.Clone(testVolumeOptions("pvc-2", 1<<30, map[string]string{lvmParamVolumeGroup: "vg0"}), &CloneSource{SnapshotID: "vg0/snapshot-1234"})
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if len(target.unexported) != 0 {
+		t.Errorf("got unexports %+v without a leftover volume", target.unexported)
+	}
+	// Thick volumes are not zeroed, every block is written.
+	runner.checkCommands(t, "dd", "dd if=/dev/vg0/snapshot-1234 of=/dev/vg0/pvc-2 bs=1M oflag=direct conv=fsync")
+}
@@ -19,20 +19,47 @@ var (
 	provisionerName = flag.String("provisioner-name", "iscsi-provisioner", "The name of this provisioner, i.e. the value `StorageClasses` will set for their `provisioner`.")
 	execMode 		= flag.String("execmode", "script", "[script/restapi..etc]")
 	scriptPath 		= flag.String("scriptpath", "path", "[--path=./prov.sh]")
+	scriptProtocol  = flag.Int("script-protocol", 0, "Script protocol version the script speaks, for scripts that do not report it when provisioning. Scripts are only asked to delete or wipe volumes from version 1 on.")
 	outOfCluster 	= flag.Bool("out-of-cluster", false, "If the provisioner is being run out of cluster. Set the master or kubeconfig flag accordingly if true. Default false.")
 	master       	= flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
 	kubeconfig 		= flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
+	restURL         = flag.String("resturl", "", "URL of the REST server used by the restapi execmode, e.g. http://localhost:8081.")
+	restUser        = flag.String("restuser", "", "User to authenticate to the REST server with. Authentication is disabled if empty.")
+	restKey         = flag.String("restkey", "", "Password of the REST server user.")
+	targetPortals   = flag.String("target-portals", "", "Comma separated portals (host or host:port) targets created by the provisioner listen on.")
+	targetIQNPrefix = flag.String("target-iqn-prefix", "iqn.2016-12.org.kubernetes.iscsi-provisioner", "Prefix of the IQNs of targets created by the provisioner, the PV name is appended to it.")
+	targetLayerName = flag.String("target-layer", "lio", "Target the lvm, file and zfs execmodes export volumes with, lio or tgt.")
+	lioConfigfsRoot = flag.String("lio-configfs-root", "/sys/kernel/config/target", "Root of the LIO configfs tree used by the lio execmode.")
+	fileIODir       = flag.String("fileio-dir", "/var/lib/iscsi-provisioner", "Directory the files of fileio backstores are created in.")
+	trashInventory  = flag.String("trash-inventory", "default/iscsi-provisioner-trash", "Namespace and name of the ConfigMap listing the volumes in the trash.")
+	lunInventory    = flag.String("lun-inventory", "default/iscsi-provisioner-luns", "Namespace and name of the ConfigMap recording the LUNs allocated on the targets of targetIQNs StorageClass parameters.")
+	fencingGracePeriod = flag.Duration("fencing-grace-period", 0, "Time a node has to be NotReady before its initiator is removed from the ACLs of volumes provisioned with nodeACL, nodeSelector or podACL. Volumes without such an ACL stay open to fenced nodes. Fencing is disabled if 0.")
 )
 
+func init() {
+	// The name of -fileio-dir before execmodes other than lio used it.
+	flag.StringVar(fileIODir, "lio-fileio-dir", *fileIODir, "Deprecated, use -fileio-dir.")
+}
+
 
 
 
 type ProvisionerConfig struct {
+	ProvisionerName string // name of this provisioner
 	Opmode string  // Operation Mode
 	Scriptpath string // Path of script
+	ScriptProtocol int // script protocol version assumed for PVs not recording one
 	Resturl string // Url of rest server
 	Restuser string // rest user
 	Restkey string // password of above use
+	TargetPortals []string // portals of targets created by the provisioner
+	TargetIQNPrefix string // prefix of IQNs of targets created by the provisioner
+	TargetLayer string // target exporting volumes of block device backends
+	LIOConfigfsRoot string // root of the LIO configfs tree
+	FileIODir string // directory of files backing fileio backstores
+	FencingGracePeriod time.Duration // time before NotReady nodes are fenced, 0 to disable
+	TrashInventory string // namespace/name of the ConfigMap listing trashed volumes
+	LunInventory string // namespace/name of the ConfigMap recording allocated LUNs
 }
 
 func main() {
@@ -45,28 +72,25 @@ func main() {
 		<-c
 		os.Exit(1)
 	}()
-	if *execMode != "" {
-		switch *execMode {
-			case "script":
-					glog.V(1).Infof("Provision a volume by executing the script")
-					provisionerConfig.Opmode = "script"
-					if *execMode == "script" && *scriptPath == "" {
-						glog.Errorf("scriptpath is nil, exiting.")
-					} else {
-						provisionerConfig.Scriptpath = *scriptPath
-					}
-			case "restapi":
-					glog.V(1).Infof("Contact REST server and provision volume")
-					provisionerConfig.Opmode = "restapi"
-					provisionerConfig.Resturl = "http://localhost:8081"
-					provisionerConfig.Restuser = "admin"
-					provisionerConfig.Restkey = "password"
-			default:
-					glog.Errorf("Unknown option for execmode")
-		}
-
+	provisionerConfig.ProvisionerName = *provisionerName
+	provisionerConfig.Opmode = *execMode
+	provisionerConfig.Scriptpath = *scriptPath
+	provisionerConfig.ScriptProtocol = *scriptProtocol
+	provisionerConfig.Resturl = *restURL
+	provisionerConfig.Restuser = *restUser
+	provisionerConfig.Restkey = *restKey
+	provisionerConfig.TargetPortals = splitList(*targetPortals)
+	provisionerConfig.TargetIQNPrefix = *targetIQNPrefix
+	provisionerConfig.TargetLayer = *targetLayerName
+	provisionerConfig.LIOConfigfsRoot = *lioConfigfsRoot
+	provisionerConfig.FileIODir = *fileIODir
+	provisionerConfig.FencingGracePeriod = *fencingGracePeriod
+	provisionerConfig.TrashInventory = *trashInventory
+	provisionerConfig.LunInventory = *lunInventory
+	glog.V(1).Infof("Provisioner Config: opmode %q, scriptpath %q, resturl %q", provisionerConfig.Opmode, provisionerConfig.Scriptpath, provisionerConfig.Resturl)
+	if provisionerConfig.FencingGracePeriod > 0 {
+		glog.Warningf("Fencing only revokes access to volumes provisioned with nodeACL, nodeSelector or podACL, volumes without an ACL stay open to fenced nodes. Nodes are not watched, and not fenced, until such a volume exists")
 	}
-	glog.Errorf("Provisioner Config :%#v", provisionerConfig)
 	
 		var config *rest.Config
 	var err error
@@ -84,6 +108,16 @@ func main() {
 		glog.Errorf("Failed to create client: %v", err)
 			os.Exit(1)
 }
-	glusterc := newiscsiController(clientset, 15*time.Second, *provisionerName, provisionerConfig)
+	driver, err := newDriver(provisionerConfig)
+	if err != nil {
+		glog.Errorf("Failed to create driver: %v", err)
+		os.Exit(1)
+	}
+	snapshotClient, err := newSnapshotClient(config)
+	if err != nil {
+		glog.Errorf("Failed to create snapshot client: %v", err)
+		os.Exit(1)
+	}
+	glusterc := newiscsiController(clientset, 15*time.Second, *provisionerName, provisionerConfig, driver, snapshotClient)
 	glusterc.Run(wait.NeverStop)
 }
\ No newline at end of file
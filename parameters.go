@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// StorageClass parameters recognized by the controller in every execmode.
+// They override what the driver reports for the volume.
+const (
+	paramTargetPortal   = "targetPortal"
+	paramIQN            = "iqn"
+	paramLun            = "lun"
+	paramFSType         = "fsType"
+	paramReadOnly       = "readOnly"
+	paramISCSIInterface = "iscsiInterface"
+	// Comma separated portals of the target, the first one is the primary.
+	paramPortals = "portals"
+	// CHAP authentication of the target, "none" (default), "chap" or
+	// "mutual".
+	paramChapAuth = "chapAuth"
+	// Comma separated initiator IQNs allowed to log in.
+	paramInitiators = "initiators"
+	// "true" to allow the initiators of the cluster nodes to log in, kept
+	// up to date as nodes come and go.
+	paramNodeACL = "nodeACL"
+	// Label selector of the nodes whose initiators are allowed to log in,
+	// implies nodeACL.
+	paramNodeSelector = "nodeSelector"
+	// "true" to allow only the initiators of the nodes running pods of the
+	// claim to log in to ReadWriteOnce volumes, implies nodeACL.
+	paramPodACL = "podACL"
+	// Comma separated access modes claims may request.
+	paramAccessModes = "accessModes"
+	// Smallest volume provisioned, smaller claims get a volume of this size.
+	paramMinSize = "minSize"
+	// Largest volume provisioned, larger claims are not provisioned.
+	paramMaxSize = "maxSize"
+	// "true" to grow volumes when their claims request more storage.
+	paramAllowExpansion = "allowExpansion"
+	// Reclaim policy of the provisioned PVs, "Delete" (default) or
+	// "Retain". StorageClasses have no field for it yet.
+	paramReclaimPolicy = "reclaimPolicy"
+	// How long the volumes of deleted PVs are kept in the trash, e.g.
+	// "72h". Volumes are deleted right away if not set.
+	paramTrashRetention = "trashRetention"
+	// How the data of volumes is erased before they are deleted, one of
+	// wipePolicies. Defaults to none.
+	paramWipePolicy = "wipePolicy"
+	// Whether each volume gets a target of its own, "dedicated" (default),
+	// or is exported as a LUN of targets shared with other volumes,
+	// "shared".
+	paramTargetMode = "targetMode"
+	// Comma separated IQNs of the shared targets, implies targetMode
+	// shared. Targets are created as needed if not set.
+	paramTargetIQNs = "targetIQNs"
+	// LUNs allocated on shared targets, "first-last". Defaults to the first
+	// LUN of the target layer up to 255.
+	paramLunRange = "lunRange"
+)
+
+// Values of the targetMode parameter.
+const (
+	targetModeDedicated = "dedicated"
+	targetModeShared    = "shared"
+)
+
+// Filesystems that can be mounted by several nodes at once.
+var clusterFSTypes = []string{"gfs2", "ocfs2"}
+
+// classParameters are the StorageClass parameters recognized by the
+// controller.
+type classParameters struct {
+	targetPortal   string
+	iqn            string
+	lun            *int32
+	fsType         string
+	readOnly       bool
+	iscsiInterface string
+	portals        []string
+	chapAuth       string
+	initiators     []string
+	nodeACL        bool
+	nodeSelector   string
+	podACL         bool
+	accessModes    []v1.PersistentVolumeAccessMode
+	// Size bounds in bytes, 0 if not set.
+	minSize        int64
+	maxSize        int64
+	allowExpansion bool
+	reclaimPolicy  v1.PersistentVolumeReclaimPolicy
+	trashRetention time.Duration
+	wipePolicy     string
+	targetMode     string
+	targetIQNs     []string
+	// LUNs allocated on shared targets, lastLun is 0 if not set.
+	firstLun int32
+	lastLun  int32
+}
+
+// supportedAccessModes returns the access modes claims may request. Unless
+// the class lists them, a volume may only be mounted read-write by a single
+// node, or by several with a cluster filesystem.
+func (p *classParameters) supportedAccessModes() []v1.PersistentVolumeAccessMode {
+	if len(p.accessModes) > 0 {
+		return p.accessModes
+	}
+	modes := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}
+	if containsString(clusterFSTypes, p.fsType) {
+		modes = append(modes, v1.ReadWriteMany)
+	}
+	return modes
+}
+
+// checkAccessModes returns an error if any of the given access modes is not
+// supported.
+func (p *classParameters) checkAccessModes(modes []v1.PersistentVolumeAccessMode) error {
+	supported := p.supportedAccessModes()
+	for _, mode := range modes {
+		found := false
+		for _, s := range supported {
+			found = found || s == mode
+		}
+		if !found {
+			return fmt.Errorf("access mode %s is not supported, supported access modes are %s", mode, joinAccessModes(supported))
+		}
+	}
+	return nil
+}
+
+// acl returns true if only some initiators may log in to the volume.
+func (p *classParameters) acl() bool {
+	return p.nodeACL || len(p.initiators) > 0
+}
+
+// aclKey describes who may log in to the volumes of the class. Volumes
+// sharing a target must have the same key.
+func (p *classParameters) aclKey() string {
+	if !p.acl() {
+		return "any"
+	}
+	initiators := append([]string(nil), p.initiators...)
+	sort.Strings(initiators)
+	key := "initiators=" + strings.Join(initiators, ",")
+	if p.nodeACL {
+		key += ";nodes=" + p.nodeSelector
+	}
+	return key
+}
+
+// sharedTargets returns true if volumes are exported as LUNs of shared
+// targets.
+func (p *classParameters) sharedTargets() bool {
+	return p.targetMode == targetModeShared
+}
+
+// parseClassParameters parses the StorageClass parameters recognized by the
+// controller and returns the remaining ones, which are left to the driver.
+func parseClassParameters(parameters map[string]string) (*classParameters, map[string]string, error) {
+	params := &classParameters{chapAuth: chapAuthNone, reclaimPolicy: v1.PersistentVolumeReclaimDelete, wipePolicy: wipePolicyNone}
+	driverParameters := make(map[string]string)
+	for name, value := range parameters {
+		switch name {
+		case paramTargetPortal:
+			if value == "" {
+				return nil, nil, fmt.Errorf("%s must not be empty", name)
+			}
+			params.targetPortal = value
+		case paramIQN:
+			if !isValidIQN(value) {
+				return nil, nil, fmt.Errorf("invalid %s %q, must start with iqn., eui. or naa.", name, value)
+			}
+			params.iqn = value
+		case paramLun:
+			lun, err := strconv.ParseInt(value, 10, 32)
+			if err != nil || lun < 0 {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be a non-negative number", name, value)
+			}
+			lun32 := int32(lun)
+			params.lun = &lun32
+		case paramFSType:
+			if value == "" {
+				return nil, nil, fmt.Errorf("%s must not be empty", name)
+			}
+			params.fsType = value
+		case paramReadOnly:
+			readOnly, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be true or false", name, value)
+			}
+			params.readOnly = readOnly
+		case paramISCSIInterface:
+			params.iscsiInterface = value
+		case paramPortals:
+			params.portals = splitList(value)
+			if len(params.portals) == 0 {
+				return nil, nil, fmt.Errorf("%s must not be empty", name)
+			}
+		case paramChapAuth:
+			if value != chapAuthNone && value != chapAuthChap && value != chapAuthMutual {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be %s, %s or %s", name, value, chapAuthNone, chapAuthChap, chapAuthMutual)
+			}
+			params.chapAuth = value
+		case paramInitiators:
+			if err := checkInitiators(name, value); err != nil {
+				return nil, nil, err
+			}
+			params.initiators = splitList(value)
+		case paramNodeACL:
+			nodeACL, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be true or false", name, value)
+			}
+			params.nodeACL = params.nodeACL || nodeACL
+		case paramNodeSelector:
+			if _, err := labels.Parse(value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %v", name, value, err)
+			}
+			params.nodeSelector = value
+			params.nodeACL = true
+		case paramPodACL:
+			podACL, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be true or false", name, value)
+			}
+			params.podACL = podACL
+			params.nodeACL = params.nodeACL || podACL
+		case paramAccessModes:
+			for _, mode := range splitList(value) {
+				switch accessMode := v1.PersistentVolumeAccessMode(mode); accessMode {
+				case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany:
+					params.accessModes = append(params.accessModes, accessMode)
+				default:
+					return nil, nil, fmt.Errorf("invalid access mode %q in %s", mode, name)
+				}
+			}
+			if len(params.accessModes) == 0 {
+				return nil, nil, fmt.Errorf("%s must not be empty", name)
+			}
+		case paramMinSize, paramMaxSize:
+			size, err := resource.ParseQuantity(value)
+			if err != nil || size.Value() <= 0 {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be a positive quantity like 1Gi", name, value)
+			}
+			if name == paramMinSize {
+				params.minSize = size.Value()
+			} else {
+				params.maxSize = size.Value()
+			}
+		case paramAllowExpansion:
+			allowExpansion, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be true or false", name, value)
+			}
+			params.allowExpansion = allowExpansion
+		case paramReclaimPolicy:
+			switch policy := v1.PersistentVolumeReclaimPolicy(value); policy {
+			case v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain:
+				params.reclaimPolicy = policy
+			default:
+				return nil, nil, fmt.Errorf("invalid %s %q, must be %s or %s", name, value, v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain)
+			}
+		case paramTrashRetention:
+			retention, err := time.ParseDuration(value)
+			if err != nil || retention <= 0 {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be a positive duration like 72h", name, value)
+			}
+			params.trashRetention = retention
+		case paramWipePolicy:
+			if !containsString(wipePolicies, value) {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be one of %s", name, value, strings.Join(wipePolicies, ", "))
+			}
+			params.wipePolicy = value
+		case paramTargetMode:
+			if value != targetModeDedicated && value != targetModeShared {
+				return nil, nil, fmt.Errorf("invalid %s %q, must be %s or %s", name, value, targetModeDedicated, targetModeShared)
+			}
+			params.targetMode = value
+		case paramTargetIQNs:
+			params.targetIQNs = splitList(value)
+			if len(params.targetIQNs) == 0 {
+				return nil, nil, fmt.Errorf("%s must not be empty", name)
+			}
+			for _, iqn := range params.targetIQNs {
+				if !isValidIQN(iqn) {
+					return nil, nil, fmt.Errorf("invalid target %q in %s", iqn, name)
+				}
+			}
+		case paramLunRange:
+			first, last, err := parseLunRange(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %v", name, value, err)
+			}
+			params.firstLun, params.lastLun = first, last
+		default:
+			driverParameters[name] = value
+		}
+	}
+	if params.minSize > 0 && params.maxSize > 0 && params.minSize > params.maxSize {
+		return nil, nil, fmt.Errorf("%s must not be larger than %s", paramMinSize, paramMaxSize)
+	}
+	if len(params.targetIQNs) > 0 {
+		if params.targetMode == targetModeDedicated {
+			return nil, nil, fmt.Errorf("%s requires %s %s", paramTargetIQNs, paramTargetMode, targetModeShared)
+		}
+		params.targetMode = targetModeShared
+	}
+	if params.targetMode == "" {
+		params.targetMode = targetModeDedicated
+	}
+	if !params.sharedTargets() {
+		if params.lastLun > 0 {
+			return nil, nil, fmt.Errorf("%s requires %s %s", paramLunRange, paramTargetMode, targetModeShared)
+		}
+	} else {
+		if params.iqn != "" || params.lun != nil {
+			return nil, nil, fmt.Errorf("%s %s cannot be set together with %s or %s", paramTargetMode, targetModeShared, paramIQN, paramLun)
+		}
+		// Targets are shared by the volumes of the class, credentials
+		// and ACLs of one volume would apply to all of them.
+		if params.chapAuth != chapAuthNone || params.podACL {
+			return nil, nil, fmt.Errorf("%s %s cannot be set together with %s or %s", paramTargetMode, targetModeShared, paramChapAuth, paramPodACL)
+		}
+	}
+	return params, driverParameters, nil
+}
+
+func joinAccessModes(modes []v1.PersistentVolumeAccessMode) string {
+	names := make([]string, 0, len(modes))
+	for _, mode := range modes {
+		names = append(names, string(mode))
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkParameters returns an error naming the first of parameters that is not
+// one of known.
+func checkParameters(parameters map[string]string, known ...string) error {
+	var unknown []string
+	for name := range parameters {
+		if !containsString(known, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown StorageClass parameter %q", unknown[0])
+	}
+	return nil
+}
+
+// isValidIQN returns true if name looks like an iSCSI name.
+func isValidIQN(name string) bool {
+	for _, prefix := range []string{"iqn.", "eui.", "naa."} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLunRange parses a range of LUNs given as first-last.
+func parseLunRange(value string) (int32, int32, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("must be first-last")
+	}
+	first, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("first LUN must be a non-negative number")
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil || last < first || last == 0 {
+		return 0, 0, fmt.Errorf("last LUN must be a positive number not smaller than the first")
+	}
+	return int32(first), int32(last), nil
+}
+
+// checkInitiators checks a comma separated list of initiator IQNs.
+func checkInitiators(name, list string) error {
+	for _, initiator := range splitList(list) {
+		if !isValidIQN(initiator) {
+			return fmt.Errorf("invalid initiator %q in %s", initiator, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func init() {
+	registerDriver("restapi", newRestDriver)
+}
+
+// The restapi execmode talks JSON over HTTP to an external volume service.
+// All requests carry basic auth credentials when a rest user is configured.
+//
+//   POST   <resturl>/volumes         restVolumeRequest -> 200/201 restVolume
+//   GET    <resturl>/volumes/<name>  -> 200 restVolume, 404 if unknown
+//   DELETE <resturl>/volumes/<name>  -> 200/204, 404 if already gone
+//
+// Failed requests should answer with a non-2xx status and a restError body.
+
+// Timeout for a single request to the REST server.
+const restRequestTimeout = 60 * time.Second
+
+// restVolumeRequest is the body of a create request.
+type restVolumeRequest struct {
+	// Name of the PV the volume is created for.
+	Name string `json:"name"`
+	// Requested size of the volume in bytes.
+	CapacityBytes int64 `json:"capacityBytes"`
+	// Access modes requested by the claim.
+	AccessModes []string `json:"accessModes,omitempty"`
+	// Parameters of the StorageClass, passed through untouched.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// CHAP credentials to configure on the target, if any.
+	Chap *chapCredentials `json:"chap,omitempty"`
+	// Initiators allowed to log in if acl is true. Any initiator may log in
+	// otherwise.
+	Initiators []string `json:"initiators,omitempty"`
+	ACL        bool     `json:"acl,omitempty"`
+}
+
+// restVolume describes a volume known to the REST server.
+type restVolume struct {
+	Name         string   `json:"name"`
+	TargetPortal string   `json:"targetPortal"`
+	IQN          string   `json:"iqn"`
+	Lun          int32    `json:"lun"`
+	SizeBytes    int64    `json:"sizeBytes,omitempty"`
+	Portals      []string `json:"portals,omitempty"`
+}
+
+// restError is the body of a failed request.
+type restError struct {
+	Error string `json:"error"`
+}
+
+// restDriver provisions volumes through the REST server.
+type restDriver struct {
+	client *restClient
+}
+
+func newRestDriver(config ProvisionerConfig) (Driver, error) {
+	if config.Resturl == "" {
+		return nil, fmt.Errorf("resturl must be set in restapi execmode")
+	}
+	return &restDriver{client: newRestClient(config.Resturl, config.Restuser, config.Restkey)}, nil
+}
+
+func (d *restDriver) Provision(options VolumeOptions) (*Volume, error) {
+	accessModes := make([]string, 0, len(options.AccessModes))
+	for _, mode := range options.AccessModes {
+		accessModes = append(accessModes, string(mode))
+	}
+	volume, err := d.client.CreateVolume(&restVolumeRequest{
+		Name:          options.PVName,
+		CapacityBytes: options.Capacity.Value(),
+		AccessModes:   accessModes,
+		Parameters:    options.Parameters,
+		Chap:          options.Chap,
+		Initiators:    options.Initiators,
+		ACL:           options.ACL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return volume.toVolume(), nil
+}
+
+func (d *restDriver) Get(pvName string) (*Volume, error) {
+	volume, err := d.client.GetVolume(pvName)
+	if err != nil || volume == nil {
+		return nil, err
+	}
+	return volume.toVolume(), nil
+}
+
+func (d *restDriver) Delete(volume *v1.PersistentVolume) error {
+	return d.client.DeleteVolume(getBackendID(volume))
+}
+
+func (v *restVolume) toVolume() *Volume {
+	volume := &Volume{
+		Portals:   append([]string{v.TargetPortal}, v.Portals...),
+		IQN:       v.IQN,
+		Lun:       v.Lun,
+		BackendID: v.Name,
+	}
+	if v.SizeBytes > 0 {
+		volume.Size = *resource.NewQuantity(v.SizeBytes, resource.BinarySI)
+	}
+	return volume
+}
+
+// restClient is a client for the restapi execmode contract.
+type restClient struct {
+	url        string
+	user       string
+	key        string
+	httpClient *http.Client
+}
+
+func newRestClient(restURL, user, key string) *restClient {
+	return &restClient{
+		url:        strings.TrimSuffix(restURL, "/"),
+		user:       user,
+		key:        key,
+		httpClient: &http.Client{Timeout: restRequestTimeout},
+	}
+}
+
+// CreateVolume asks the REST server to create a volume.
+func (c *restClient) CreateVolume(req *restVolumeRequest) (*restVolume, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	volume := &restVolume{}
+	if _, err := c.do("POST", "/volumes", bytes.NewReader(body), volume); err != nil {
+		return nil, err
+	}
+	if volume.TargetPortal == "" || volume.IQN == "" {
+		return nil, fmt.Errorf("REST server returned volume %q without target portal or IQN", req.Name)
+	}
+	return volume, nil
+}
+
+// GetVolume returns the volume with the given name or nil if the REST server
+// does not know it.
+func (c *restClient) GetVolume(name string) (*restVolume, error) {
+	volume := &restVolume{}
+	status, err := c.do("GET", volumePath(name), nil, volume)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// DeleteVolume asks the REST server to delete a volume. Deleting a volume the
+// server does not know is not an error.
+func (c *restClient) DeleteVolume(name string) error {
+	status, err := c.do("DELETE", volumePath(name), nil, nil)
+	if status == http.StatusNotFound {
+		glog.V(4).Infof("volume %q not found on REST server, assuming it is deleted", name)
+		return nil
+	}
+	return err
+}
+
+// volumePath returns the path of the volume with the given name, which is
+// escaped as a single path segment.
+func volumePath(name string) string {
+	return "/volumes/" + strings.Replace((&url.URL{Path: name}).EscapedPath(), "/", "%2F", -1)
+}
+
+// do sends a request and decodes a successful response into out, if given.
+// It returns the HTTP status code of the response, or 0 when no response was
+// received.
+func (c *restClient) do(method, path string, body io.Reader, out interface{}) (int, error) {
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.key)
+	}
+
+	glog.V(4).Infof("REST request %s %s", method, req.URL)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("REST request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("error reading REST response for %s %s: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		restErr := restError{}
+		if json.Unmarshal(data, &restErr) == nil && restErr.Error != "" {
+			return resp.StatusCode, fmt.Errorf("REST request %s %s failed with %s: %s", method, path, resp.Status, restErr.Error)
+		}
+		return resp.StatusCode, fmt.Errorf("REST request %s %s failed with %s", method, path, resp.Status)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("error decoding REST response for %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// restTestServer is a REST server recording the requests it gets.
+type restTestServer struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   []string
+	// status and body of the responses.
+	status int
+	body   string
+}
+
+func newRestTestServer(status int, body string) *restTestServer {
+	s := &restTestServer{status: status, body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(data))
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.body))
+	}))
+	return s
+}
+
+func (s *restTestServer) lastRequest(t *testing.T) *http.Request {
+	if len(s.requests) != 1 {
+		t.Fatalf("got %d requests, expected 1", len(s.requests))
+	}
+	return s.requests[0]
+}
+
+func TestRestCreateVolume(t *testing.T) {
+	server := newRestTestServer(http.StatusCreated, `{"name":"vol-17","targetPortal":"192.168.43.65","portals":["192.168.44.65"],"iqn":"iqn.2016-12.example.server:vol-17","lun":3,"sizeBytes":2147483648}`)
+	defer server.Close()
+	driver := &restDriver{client: newRestClient(server.URL+"/", "admin", "secret")}
+
+	volume, err := driver.Provision(VolumeOptions{
+		Capacity:    *resource.NewQuantity(1<<30, resource.BinarySI),
+		AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PVName:      "pvc-1",
+		Parameters:  map[string]string{"pool": "fast"},
+		Initiators:  []string{"iqn.2016-12.example.node:node1"},
+		ACL:         true,
+	})
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	req := server.lastRequest(t)
+	if req.Method != "POST" || req.URL.Path != "/volumes" {
+		t.Errorf("got request %s %s, expected POST /volumes", req.Method, req.URL.Path)
+	}
+	if req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got Content-Type %q, expected application/json", req.Header.Get("Content-Type"))
+	}
+	sent := restVolumeRequest{}
+	if err := json.Unmarshal([]byte(server.bodies[0]), &sent); err != nil {
+		t.Fatalf("cannot decode request %q: %v", server.bodies[0], err)
+	}
+	if sent.Name != "pvc-1" || sent.CapacityBytes != 1<<30 || sent.Parameters["pool"] != "fast" || !sent.ACL ||
+		!equalStrings(sent.AccessModes, []string{"ReadWriteOnce"}) || !equalStrings(sent.Initiators, []string{"iqn.2016-12.example.node:node1"}) {
+		t.Errorf("unexpected request %+v", sent)
+	}
+
+	if !equalStrings(volume.Portals, []string{"192.168.43.65", "192.168.44.65"}) {
+		t.Errorf("got portals %v", volume.Portals)
+	}
+	if volume.IQN != "iqn.2016-12.example.server:vol-17" || volume.Lun != 3 || volume.BackendID != "vol-17" {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+	if volume.Size.Value() != 2147483648 {
+		t.Errorf("got size %s, expected 2Gi", volume.Size.String())
+	}
+}
+
+func TestRestCreateVolumeWithoutIQN(t *testing.T) {
+	server := newRestTestServer(http.StatusOK, `{"name":"vol-17","targetPortal":"192.168.43.65"}`)
+	defer server.Close()
+	client := newRestClient(server.URL, "", "")
+
+	if _, err := client.CreateVolume(&restVolumeRequest{Name: "pvc-1"}); err == nil {
+		t.Errorf("CreateVolume succeeded for a volume without IQN")
+	}
+}
+
+func TestRestGetVolume(t *testing.T) {
+	server := newRestTestServer(http.StatusOK, `{"name":"vol-17","targetPortal":"192.168.43.65","iqn":"iqn.2016-12.example.server:vol-17","lun":0}`)
+	defer server.Close()
+	driver := &restDriver{client: newRestClient(server.URL, "", "")}
+
+	volume, err := driver.Get("pvc-1")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	req := server.lastRequest(t)
+	if req.Method != "GET" || req.URL.Path != "/volumes/pvc-1" {
+		t.Errorf("got request %s %s, expected GET /volumes/pvc-1", req.Method, req.URL.Path)
+	}
+	if volume == nil || volume.IQN != "iqn.2016-12.example.server:vol-17" {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+}
+
+func TestRestGetVolumeNotFound(t *testing.T) {
+	server := newRestTestServer(http.StatusNotFound, `{"error":"no such volume"}`)
+	defer server.Close()
+	driver := &restDriver{client: newRestClient(server.URL, "", "")}
+
+	volume, err := driver.Get("pvc-1")
+	if err != nil || volume != nil {
+		t.Errorf("got volume %+v and error %v, expected neither", volume, err)
+	}
+}
+
+func TestRestDeleteVolume(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		wantErr string
+	}{
+		{status: http.StatusNoContent},
+		{status: http.StatusOK, body: `{}`},
+		// Already deleted.
+		{status: http.StatusNotFound},
+		{status: http.StatusInternalServerError, body: `{"error":"volume is busy"}`, wantErr: "volume is busy"},
+		{status: http.StatusConflict, body: "busy", wantErr: "409 Conflict"},
+	}
+	for _, test := range tests {
+		server := newRestTestServer(test.status, test.body)
+		driver := &restDriver{client: newRestClient(server.URL, "", "")}
+		err := driver.Delete(&v1.PersistentVolume{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "pvc-1",
+				Annotations: map[string]string{annBackendID: "vol-17"},
+			},
+		})
+		server.Close()
+
+		req := server.lastRequest(t)
+		if req.Method != "DELETE" || req.URL.Path != "/volumes/vol-17" {
+			t.Errorf("got request %s %s, expected DELETE /volumes/vol-17", req.Method, req.URL.Path)
+		}
+		if test.wantErr == "" && err != nil {
+			t.Errorf("status %d: unexpected error %v", test.status, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("status %d: got error %v, expected one containing %q", test.status, err, test.wantErr)
+		}
+	}
+}
+
+func TestRestErrorStatus(t *testing.T) {
+	server := newRestTestServer(http.StatusForbidden, `{"error":"quota exceeded"}`)
+	defer server.Close()
+	client := newRestClient(server.URL, "", "")
+
+	_, err := client.CreateVolume(&restVolumeRequest{Name: "pvc-1"})
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("got error %v, expected the error of the server", err)
+	}
+	if _, err := client.GetVolume("pvc-1"); err == nil {
+		t.Errorf("GetVolume succeeded with status 403")
+	}
+}
+
+func TestRestEscapesVolumeNames(t *testing.T) {
+	server := newRestTestServer(http.StatusNoContent, "")
+	defer server.Close()
+	client := newRestClient(server.URL, "", "")
+
+	if err := client.DeleteVolume("pool a/vol+1"); err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+	req := server.lastRequest(t)
+	if path := req.URL.EscapedPath(); path != "/volumes/pool%20a%2Fvol+1" {
+		t.Errorf("got path %q, expected the name as a single escaped segment", path)
+	}
+}
+
+func TestRestBasicAuth(t *testing.T) {
+	tests := []struct {
+		user, key string
+	}{
+		{user: "admin", key: "secret"},
+		{},
+	}
+	for _, test := range tests {
+		server := newRestTestServer(http.StatusNotFound, "")
+		client := newRestClient(server.URL, test.user, test.key)
+		client.GetVolume("pvc-1")
+		server.Close()
+
+		user, key, ok := server.lastRequest(t).BasicAuth()
+		if test.user == "" {
+			if ok {
+				t.Errorf("got credentials %q:%q without a rest user", user, key)
+			}
+			continue
+		}
+		if !ok || user != test.user || key != test.key {
+			t.Errorf("got credentials %q:%q, expected %q:%q", user, key, test.user, test.key)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// commandRunner runs external commands. Drivers run their tools through it so
+// that tests can replace them with a fake.
+type commandRunner interface {
+	// Run runs the named command and returns its combined output.
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// execRunner is the commandRunner running commands on the host.
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	glog.V(4).Infof("running %s %s", name, strings.Join(args, " "))
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeRunner is a commandRunner recording the commands it is asked to run
+// instead of running them. Commands get the output of the first response
+// whose prefix they start with, or no output.
+type fakeRunner struct {
+	commands  []string
+	responses []*fakeResponse
+}
+
+type fakeResponse struct {
+	prefix string
+	out    string
+	err    error
+	// once is true if the response is only given to the first command
+	// matching it.
+	once bool
+	used bool
+}
+
+// respond makes commands starting with prefix print out.
+func (r *fakeRunner) respond(prefix, out string) {
+	r.responses = append(r.responses, &fakeResponse{prefix: prefix, out: out})
+}
+
+// respondOnce makes the next command starting with prefix print out.
+func (r *fakeRunner) respondOnce(prefix, out string) {
+	r.responses = append(r.responses, &fakeResponse{prefix: prefix, out: out, once: true})
+}
+
+// fail makes commands starting with prefix fail with the given message.
+func (r *fakeRunner) fail(prefix, message string) {
+	r.responses = append(r.responses, &fakeResponse{prefix: prefix, out: message, err: errors.New(message)})
+}
+
+func (r *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	for _, response := range r.responses {
+		if response.used || !strings.HasPrefix(command, response.prefix) {
+			continue
+		}
+		response.used = response.once
+		return []byte(response.out), response.err
+	}
+	return nil, nil
+}
+
+// ran returns the commands that were run starting with prefix.
+func (r *fakeRunner) ran(prefix string) []string {
+	var commands []string
+	for _, command := range r.commands {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// checkCommands checks that the commands starting with prefix were run in the
+// given order and no others.
+func (r *fakeRunner) checkCommands(t *testing.T, prefix string, want ...string) {
+	got := r.ran(prefix)
+	if !equalStrings(got, want) {
+		t.Errorf("got commands\n\t%s\nexpected\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
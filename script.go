@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func init() {
+	registerDriver("script", newScriptDriver)
+}
+
+// Version of the script protocol spoken by this provisioner.
+//
+// The script is run as `sh <scriptpath> <operation>` with a scriptRequest as
+// JSON on stdin and the same information in ISCSI_* environment variables. It
+// should print a scriptResponse as JSON on stdout. Scripts written before the
+// protocol existed may instead print the target portal and the IQN separated
+// by whitespace. Such scripts ignore the operation and would provision
+// another volume when asked to delete one, so only scripts that reported
+// protocol version 1 or later in their provision response, or with the
+// -script-protocol flag, are asked to do anything but provisioning.
+const scriptProtocolVersion = 1
+
+// This annotation is added to the PVs provisioned by scripts that reported
+// a protocol version and holds it.
+const annScriptProtocol = "iscsi-provisioner/script-protocol"
+
+// Operations a script is asked to perform.
+const (
+	scriptOperationProvision = "provision"
+	scriptOperationDelete    = "delete"
+	scriptOperationWipe      = "wipe"
+)
+
+// scriptRequest is written to the script's stdin.
+type scriptRequest struct {
+	Version        int               `json:"version"`
+	Operation      string            `json:"operation"`
+	PVName         string            `json:"pvName"`
+	ClaimNamespace string            `json:"claimNamespace,omitempty"`
+	ClaimName      string            `json:"claimName,omitempty"`
+	CapacityBytes  int64             `json:"capacityBytes,omitempty"`
+	AccessModes    []string          `json:"accessModes,omitempty"`
+	Parameters     map[string]string `json:"parameters,omitempty"`
+	// CHAP credentials to configure on the target, provision only.
+	Chap *chapCredentials `json:"chap,omitempty"`
+	// Initiators allowed to log in if acl is true, provision only. Any
+	// initiator may log in otherwise.
+	Initiators []string `json:"initiators,omitempty"`
+	ACL        bool     `json:"acl,omitempty"`
+	// Set for all operations but provision, as recorded at provision time.
+	BackendID string `json:"backendID,omitempty"`
+	Portal    string `json:"portal,omitempty"`
+	IQN       string `json:"iqn,omitempty"`
+	Lun       int32  `json:"lun,omitempty"`
+	// Wipe policy, wipe only.
+	WipePolicy string `json:"wipePolicy,omitempty"`
+}
+
+// scriptResponse is read from the script's stdout.
+type scriptResponse struct {
+	Version   int                  `json:"version"`
+	Portal    string               `json:"portal,omitempty"`
+	Portals   []string             `json:"portals,omitempty"`
+	IQN       string               `json:"iqn,omitempty"`
+	Lun       int32                `json:"lun,omitempty"`
+	FSType    string               `json:"fsType,omitempty"`
+	SizeBytes int64                `json:"sizeBytes,omitempty"`
+	BackendID string               `json:"backendID,omitempty"`
+	Error     *scriptResponseError `json:"error,omitempty"`
+}
+
+// scriptResponseError is reported by a script that failed.
+type scriptResponseError struct {
+	Message string `json:"message"`
+	// Retryable tells whether the operation may succeed if run again.
+	Retryable bool `json:"retryable"`
+}
+
+func (e *scriptResponseError) Error() string {
+	return e.Message
+}
+
+func (e *scriptResponseError) Temporary() bool {
+	return e.Retryable
+}
+
+// scriptDriver provisions volumes by running an external script.
+type scriptDriver struct {
+	path string
+	// Protocol version of PVs not annotated with one.
+	protocol int
+}
+
+func newScriptDriver(config ProvisionerConfig) (Driver, error) {
+	if config.Scriptpath == "" {
+		return nil, fmt.Errorf("scriptpath must be set in script execmode")
+	}
+	return &scriptDriver{path: config.Scriptpath, protocol: config.ScriptProtocol}, nil
+}
+
+func (d *scriptDriver) Provision(options VolumeOptions) (*Volume, error) {
+	req := &scriptRequest{
+		Version:       scriptProtocolVersion,
+		Operation:     scriptOperationProvision,
+		PVName:        options.PVName,
+		CapacityBytes: options.Capacity.Value(),
+		Parameters:    options.Parameters,
+		Chap:          options.Chap,
+		Initiators:    options.Initiators,
+		ACL:           options.ACL,
+	}
+	if options.PVC != nil {
+		req.ClaimNamespace = options.PVC.Namespace
+		req.ClaimName = options.PVC.Name
+	}
+	for _, mode := range options.AccessModes {
+		req.AccessModes = append(req.AccessModes, string(mode))
+	}
+
+	resp, err := d.run(req)
+	if err != nil {
+		return nil, err
+	}
+	var portals []string
+	if resp.Portal != "" {
+		portals = append(portals, resp.Portal)
+	}
+	portals = append(portals, resp.Portals...)
+	if len(portals) == 0 || resp.IQN == "" {
+		return nil, fmt.Errorf("script %s returned no target portal or IQN", d.path)
+	}
+	volume := &Volume{
+		Portals:   portals,
+		IQN:       resp.IQN,
+		Lun:       resp.Lun,
+		FSType:    resp.FSType,
+		BackendID: resp.BackendID,
+	}
+	if resp.SizeBytes > 0 {
+		volume.Size = *resource.NewQuantity(resp.SizeBytes, resource.BinarySI)
+	}
+	if resp.Version > 0 {
+		volume.Annotations = map[string]string{annScriptProtocol: strconv.Itoa(resp.Version)}
+	}
+	return volume, nil
+}
+
+// protocolVersion returns the protocol version of the script that
+// provisioned a PV.
+func (d *scriptDriver) protocolVersion(volume *v1.PersistentVolume) int {
+	if value, found := volume.Annotations[annScriptProtocol]; found {
+		if version, err := strconv.Atoi(value); err == nil {
+			return version
+		}
+		glog.V(3).Infof("ignoring invalid %s annotation %q of volume %q", annScriptProtocol, value, volume.Name)
+	}
+	return d.protocol
+}
+
+// checkProtocol returns a permanent error if the script that provisioned a
+// PV cannot be asked to perform the given operation on it.
+func (d *scriptDriver) checkProtocol(operation string, volume *v1.PersistentVolume) error {
+	if d.protocolVersion(volume) < 1 {
+		return permanentError{fmt.Errorf("script %s does not support %s: it reported no protocol version when provisioning volume %q, set -script-protocol=1 if it speaks version 1", d.path, operation, volume.Name)}
+	}
+	return nil
+}
+
+func (d *scriptDriver) Delete(volume *v1.PersistentVolume) error {
+	if err := d.checkProtocol(scriptOperationDelete, volume); err != nil {
+		return err
+	}
+	req := newScriptVolumeRequest(scriptOperationDelete, volume)
+	_, err := d.run(req)
+	return err
+}
+
+// CanWipe accepts any wipe policy, scripts report the ones they do not
+// support when asked to wipe.
+func (d *scriptDriver) CanWipe(policy string) bool {
+	return true
+}
+
+// Wipe asks the script to wipe a volume. The script must confirm it with a
+// JSON response, a legacy script would print nothing or a target.
+func (d *scriptDriver) Wipe(volume *v1.PersistentVolume, policy string) error {
+	if err := d.checkProtocol(scriptOperationWipe, volume); err != nil {
+		return err
+	}
+	req := newScriptVolumeRequest(scriptOperationWipe, volume)
+	req.WipePolicy = policy
+	_, err := d.run(req)
+	return err
+}
+
+// newScriptVolumeRequest returns a request for an operation on the storage
+// asset of an existing PV.
+func newScriptVolumeRequest(operation string, volume *v1.PersistentVolume) *scriptRequest {
+	req := &scriptRequest{
+		Version:   scriptProtocolVersion,
+		Operation: operation,
+		PVName:    volume.Name,
+		BackendID: getBackendID(volume),
+	}
+	if volume.Spec.ClaimRef != nil {
+		req.ClaimNamespace = volume.Spec.ClaimRef.Namespace
+		req.ClaimName = volume.Spec.ClaimRef.Name
+	}
+	if capacity, found := volume.Spec.Capacity[v1.ResourceStorage]; found {
+		req.CapacityBytes = capacity.Value()
+	}
+	if iscsi := volume.Spec.ISCSI; iscsi != nil {
+		req.Portal = iscsi.TargetPortal
+		req.IQN = iscsi.IQN
+		req.Lun = iscsi.Lun
+	}
+	return req
+}
+
+// run runs the script for the given request and returns its response.
+func (d *scriptDriver) run(req *scriptRequest) (*scriptResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("sh", d.path, req.Operation)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"ISCSI_PROTOCOL_VERSION="+strconv.Itoa(req.Version),
+		"ISCSI_OPERATION="+req.Operation,
+		"ISCSI_PV_NAME="+req.PVName,
+		"ISCSI_CLAIM_NAMESPACE="+req.ClaimNamespace,
+		"ISCSI_CLAIM_NAME="+req.ClaimName,
+		"ISCSI_CAPACITY_BYTES="+strconv.FormatInt(req.CapacityBytes, 10),
+		"ISCSI_BACKEND_ID="+req.BackendID,
+		"ISCSI_WIPE_POLICY="+req.WipePolicy,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	glog.V(4).Infof("running script %s %s for volume %q", d.path, req.Operation, req.PVName)
+	runErr := cmd.Run()
+
+	resp, parseErr := parseScriptResponse(stdout.Bytes(), req.Operation)
+	if parseErr == nil && resp.Error != nil {
+		return nil, resp.Error
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("script %s %s failed: %v: %s", d.path, req.Operation, runErr, strings.TrimSpace(stderr.String()))
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("script %s %s: %v", d.path, req.Operation, parseErr)
+	}
+	return resp, nil
+}
+
+// parseScriptResponse parses the output of a script for the given
+// operation, a JSON scriptResponse or, for provisioning only, the legacy
+// "<portal> <iqn>" output. Deletion does not require the script to print
+// anything, wiping requires a JSON response with a protocol version.
+func parseScriptResponse(out []byte, operation string) (*scriptResponse, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		if operation == scriptOperationDelete {
+			return &scriptResponse{}, nil
+		}
+		return nil, fmt.Errorf("no output")
+	}
+	if out[0] != '{' {
+		if operation != scriptOperationProvision {
+			return nil, fmt.Errorf("expected a JSON response or no output, got %q", string(out))
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("expected target portal and IQN in output, got %q", string(out))
+		}
+		return &scriptResponse{Portal: fields[0], IQN: fields[1]}, nil
+	}
+
+	resp := &scriptResponse{}
+	if err := json.Unmarshal(out, resp); err != nil {
+		return nil, fmt.Errorf("error decoding output: %v", err)
+	}
+	if resp.Version > scriptProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, at most %d is supported", resp.Version, scriptProtocolVersion)
+	}
+	if operation == scriptOperationWipe && resp.Version < 1 && resp.Error == nil {
+		return nil, fmt.Errorf("wipe not confirmed, expected a response with version %d", scriptProtocolVersion)
+	}
+	return resp, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/dynamic"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	apierrs "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	extensions "k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/watch"
+	"k8s.io/client-go/1.4/rest"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+// Snapshots of volumes are requested with VolumeSnapshot objects, a third
+// party resource registered by the provisioner:
+//
+//	apiVersion: iscsi-provisioner.io/v1
+//	kind: VolumeSnapshot
+//	metadata:
+//	  name: before-upgrade
+//	spec:
+//	  claimName: iscsivolume
+//
+// The provisioner fills in the status once the snapshot is taken. Deleting
+// the object deletes the snapshot. Backend snapshots are named after the UID
+// of their object, snapshots whose object is gone are swept periodically so
+// that failed or missed deletions are retried.
+const (
+	snapshotResourceName = "volume-snapshot.iscsi-provisioner.io"
+	snapshotGroup        = "iscsi-provisioner.io"
+	snapshotVersion      = "v1"
+	snapshotKind         = "VolumeSnapshot"
+	snapshotResource     = "volumesnapshots"
+)
+
+// Prefix of the names of backend snapshots, followed by the UID of their
+// VolumeSnapshot object.
+const backendSnapshotPrefix = "snapshot-"
+
+// Interval between sweeps for backend snapshots whose VolumeSnapshot object
+// is gone.
+const snapshotSweepInterval = 5 * time.Minute
+
+// volumeSnapshot is a VolumeSnapshot object.
+type volumeSnapshot struct {
+	unversioned.TypeMeta `json:",inline"`
+	Metadata             v1.ObjectMeta        `json:"metadata"`
+	Spec                 volumeSnapshotSpec   `json:"spec"`
+	Status               volumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotSpec struct {
+	// Name of the claim in the namespace of the snapshot whose volume is
+	// snapshotted.
+	ClaimName string `json:"claimName"`
+}
+
+type volumeSnapshotStatus struct {
+	// Ready is true once the snapshot is taken.
+	Ready bool `json:"ready"`
+	// Size of the volume when the snapshot was taken, in bytes.
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// CreationTime of the snapshot on the backend.
+	CreationTime *unversioned.Time `json:"creationTime,omitempty"`
+	// Error is set if the snapshot cannot be taken, it is not retried.
+	Error string `json:"error,omitempty"`
+	// Name of the PV the snapshot was taken of.
+	VolumeName string `json:"volumeName,omitempty"`
+	// StorageClass of the PV the snapshot was taken of.
+	StorageClass string `json:"storageClass,omitempty"`
+	// Execmode of the driver that took the snapshot.
+	ExecMode string `json:"execMode,omitempty"`
+	// SnapshotID identifies the snapshot on the backend.
+	SnapshotID string `json:"snapshotID,omitempty"`
+}
+
+// newSnapshotClient returns a client for VolumeSnapshot objects.
+func newSnapshotClient(config *rest.Config) (*dynamic.Client, error) {
+	snapshotConfig := *config
+	snapshotConfig.APIPath = "/apis"
+	snapshotConfig.GroupVersion = &unversioned.GroupVersion{Group: snapshotGroup, Version: snapshotVersion}
+	client, err := dynamic.NewClient(&snapshotConfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.ParameterCodec(dynamic.VersionedParameterEncoderWithV1Fallback), nil
+}
+
+// ensureSnapshotResource registers the VolumeSnapshot third party resource
+// unless it exists.
+func ensureSnapshotResource(client kubernetes.Interface) error {
+	tpr := &extensions.ThirdPartyResource{
+		ObjectMeta:  v1.ObjectMeta{Name: snapshotResourceName},
+		Description: "Point in time snapshot of a volume provisioned by iscsi-provisioner",
+		Versions:    []extensions.APIVersion{{Name: snapshotVersion}},
+	}
+	_, err := client.Extensions().ThirdPartyResources().Create(tpr)
+	if apierrs.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// snapshots returns a client for the VolumeSnapshot objects of a namespace,
+// of all namespaces if namespace is empty.
+func (ctrl *iscsiController) snapshots(namespace string) *dynamic.ResourceClient {
+	return ctrl.snapshotClient.Resource(&unversioned.APIResource{
+		Name:       snapshotResource,
+		Namespaced: true,
+		Kind:       snapshotKind,
+	}, namespace)
+}
+
+// newSnapshotSource returns a ListerWatcher of the VolumeSnapshot objects of
+// all namespaces.
+func (ctrl *iscsiController) newSnapshotSource() cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return ctrl.snapshots(v1.NamespaceAll).List(&options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return ctrl.snapshots(v1.NamespaceAll).Watch(&options)
+		},
+	}
+}
+
+func decodeSnapshot(obj *runtime.Unstructured) (*volumeSnapshot, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &volumeSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("error decoding %s %s/%s: %v", snapshotKind, obj.GetNamespace(), obj.GetName(), err)
+	}
+	return snapshot, nil
+}
+
+func encodeSnapshot(snapshot *volumeSnapshot) (*runtime.Unstructured, error) {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	obj := &runtime.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// backendSnapshotName returns the name of the backend snapshot of a
+// VolumeSnapshot object, unique across namespaces.
+func backendSnapshotName(snapshot *volumeSnapshot) string {
+	return backendSnapshotPrefix + string(snapshot.Metadata.UID)
+}
+
+func snapshotKey(snapshot *volumeSnapshot) string {
+	return fmt.Sprintf("%s/%s[%s]", snapshot.Metadata.Namespace, snapshot.Metadata.Name, string(snapshot.Metadata.UID))
+}
+
+// On add snapshot, take it unless it is taken or failed.
+func (ctrl *iscsiController) addSnapshot(obj interface{}) {
+	unstructured, ok := obj.(*runtime.Unstructured)
+	if !ok {
+		glog.Errorf("Expected %s but handler received %#v", snapshotKind, obj)
+		return
+	}
+	snapshot, err := decodeSnapshot(unstructured)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if snapshot.Status.Ready || snapshot.Status.Error != "" {
+		return
+	}
+	// Operations on a backend snapshot are serialized by its name.
+	ctrl.scheduleOperation(backendSnapshotName(snapshot), func() error {
+		ctrl.createSnapshotOperation(snapshot)
+		return nil
+	})
+}
+
+// On update snapshot, pass the new snapshot to addSnapshot. Updates occur at
+// least every resyncPeriod.
+func (ctrl *iscsiController) updateSnapshot(oldObj, newObj interface{}) {
+	ctrl.addSnapshot(newObj)
+}
+
+// On delete snapshot, delete the backend snapshot if it was taken.
+func (ctrl *iscsiController) deleteSnapshot(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	unstructured, ok := obj.(*runtime.Unstructured)
+	if !ok {
+		glog.Errorf("Expected %s but handler received %#v", snapshotKind, obj)
+		return
+	}
+	snapshot, err := decodeSnapshot(unstructured)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if snapshot.Status.SnapshotID == "" || snapshot.Status.ExecMode != ctrl.provisionerConfig.Opmode {
+		return
+	}
+	ctrl.scheduleOperation(backendSnapshotName(snapshot), func() error {
+		ctrl.deleteSnapshotOperation(snapshot)
+		return nil
+	})
+}
+
+// createSnapshotOperation takes a snapshot of the volume bound to the claim
+// of a VolumeSnapshot object and records it in its status.
+func (ctrl *iscsiController) createSnapshotOperation(snapshot *volumeSnapshot) {
+	key := snapshotKey(snapshot)
+	glog.V(4).Infof("createSnapshotOperation [%s] started", key)
+
+	// The snapshot may have been taken while we were waiting.
+	obj, err := ctrl.snapshots(snapshot.Metadata.Namespace).Get(snapshot.Metadata.Name)
+	if err != nil {
+		glog.V(3).Infof("error reading %s %s: %v", snapshotKind, key, err)
+		return
+	}
+	if snapshot, err = decodeSnapshot(obj); err != nil {
+		glog.Error(err)
+		return
+	}
+	if snapshot.Status.Ready || snapshot.Status.Error != "" {
+		return
+	}
+
+	volume, err := ctrl.snapshotVolume(snapshot)
+	if err != nil {
+		snapshot.Status.Error = err.Error()
+		ctrl.eventRecorder.Event(obj, v1.EventTypeWarning, "SnapshotFailed", err.Error())
+		ctrl.saveSnapshot(snapshot)
+		return
+	}
+	taken, err := ctrl.driver.(Snapshotter).Snapshot(volume, backendSnapshotName(snapshot))
+	if err != nil {
+		strerr := fmt.Sprintf("Failed to snapshot volume %s: %v", volume.Name, err)
+		glog.V(3).Info(strerr)
+		ctrl.eventRecorder.Event(obj, v1.EventTypeWarning, "SnapshotFailed", strerr)
+		if !isTemporary(err) {
+			snapshot.Status.Error = strerr
+			ctrl.saveSnapshot(snapshot)
+		}
+		return
+	}
+
+	creationTime := unversioned.NewTime(taken.CreationTime)
+	snapshot.Status = volumeSnapshotStatus{
+		Ready:        true,
+		SizeBytes:    taken.SizeBytes,
+		CreationTime: &creationTime,
+		VolumeName:   volume.Name,
+		StorageClass: volume.Annotations[annClass],
+		ExecMode:     ctrl.provisionerConfig.Opmode,
+		SnapshotID:   taken.ID,
+	}
+	if err := ctrl.saveSnapshot(snapshot); err != nil {
+		// The backend snapshot is found again by its name on retry.
+		return
+	}
+	glog.V(2).Infof("snapshot %s of volume %q taken", key, volume.Name)
+	ctrl.eventRecorder.Event(obj, v1.EventTypeNormal, "SnapshotCreated", fmt.Sprintf("Took snapshot %s of volume %s", taken.ID, volume.Name))
+}
+
+// snapshotVolume returns the volume a VolumeSnapshot object is to be taken
+// of, which must be bound to its claim and provisioned by us.
+func (ctrl *iscsiController) snapshotVolume(snapshot *volumeSnapshot) (*v1.PersistentVolume, error) {
+	if snapshot.Spec.ClaimName == "" {
+		return nil, fmt.Errorf("spec.claimName must be set")
+	}
+	claim, err := ctrl.client.Core().PersistentVolumeClaims(snapshot.Metadata.Namespace).Get(snapshot.Spec.ClaimName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading claim %s/%s: %v", snapshot.Metadata.Namespace, snapshot.Spec.ClaimName, err)
+	}
+	if claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("claim %s is not bound", claimToClaimKey(claim))
+	}
+	volume, err := ctrl.client.Core().PersistentVolumes().Get(claim.Spec.VolumeName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading volume %q: %v", claim.Spec.VolumeName, err)
+	}
+	if volume.Annotations[annDynamicallyProvisioned] != ctrl.provisionerName ||
+		volume.Annotations[annExecMode] != ctrl.provisionerConfig.Opmode {
+		return nil, fmt.Errorf("volume %q was not provisioned by %s in %s execmode", volume.Name, ctrl.provisionerName, ctrl.provisionerConfig.Opmode)
+	}
+	return volume, nil
+}
+
+// saveSnapshot updates a VolumeSnapshot object.
+func (ctrl *iscsiController) saveSnapshot(snapshot *volumeSnapshot) error {
+	obj, err := encodeSnapshot(snapshot)
+	if err == nil {
+		_, err = ctrl.snapshots(snapshot.Metadata.Namespace).Update(obj)
+	}
+	if err != nil {
+		glog.V(3).Infof("failed to update %s %s: %v", snapshotKind, snapshotKey(snapshot), err)
+	}
+	return err
+}
+
+// deleteSnapshotOperation deletes the backend snapshot of a deleted
+// VolumeSnapshot object.
+func (ctrl *iscsiController) deleteSnapshotOperation(snapshot *volumeSnapshot) {
+	key := snapshotKey(snapshot)
+	glog.V(4).Infof("deleteSnapshotOperation [%s] started", key)
+	if err := ctrl.driver.(Snapshotter).DeleteSnapshot(snapshot.Status.SnapshotID); err != nil {
+		// The object is gone, report on the volume instead. The
+		// snapshot is deleted again by sweepSnapshots.
+		strerr := fmt.Sprintf("Failed to delete snapshot %s of %s %s: %v", snapshot.Status.SnapshotID, snapshotKind, key, err)
+		glog.V(2).Info(strerr)
+		if volume, getErr := ctrl.client.Core().PersistentVolumes().Get(snapshot.Status.VolumeName); getErr == nil {
+			ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "SnapshotDeleteFailed", strerr)
+		}
+		return
+	}
+	glog.V(2).Infof("snapshot %s of %s %s deleted", snapshot.Status.SnapshotID, snapshotKind, key)
+}
+
+// sweepSnapshots deletes the backend snapshots of our volumes whose
+// VolumeSnapshot object is gone, e.g. because deleting them failed or the
+// object was deleted while the provisioner was not running.
+func (ctrl *iscsiController) sweepSnapshots() {
+	if !ctrl.snapshotController.HasSynced() {
+		return
+	}
+	uids := make(map[string]bool)
+	for _, obj := range ctrl.snapshotStore.List() {
+		if unstructured, ok := obj.(*runtime.Unstructured); ok {
+			uids[string(unstructured.GetUID())] = true
+		}
+	}
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok || volume.Spec.ISCSI == nil ||
+			volume.Annotations[annDynamicallyProvisioned] != ctrl.provisionerName ||
+			volume.Annotations[annExecMode] != ctrl.provisionerConfig.Opmode {
+			continue
+		}
+		ids, err := ctrl.driver.(Snapshotter).ListSnapshots(volume)
+		if err != nil {
+			glog.Errorf("failed to list the snapshots of volume %q: %v", volume.Name, err)
+			continue
+		}
+		for name, id := range ids {
+			if !strings.HasPrefix(name, backendSnapshotPrefix) || uids[strings.TrimPrefix(name, backendSnapshotPrefix)] {
+				continue
+			}
+			volume, id := volume, id
+			ctrl.scheduleOperation(name, func() error {
+				ctrl.deleteOrphanedSnapshotOperation(volume, id)
+				return nil
+			})
+		}
+	}
+}
+
+// deleteOrphanedSnapshotOperation deletes a backend snapshot of the given PV
+// whose VolumeSnapshot object is gone.
+func (ctrl *iscsiController) deleteOrphanedSnapshotOperation(volume *v1.PersistentVolume, id string) {
+	glog.V(4).Infof("deleteOrphanedSnapshotOperation [%s] started", id)
+	if err := ctrl.driver.(Snapshotter).DeleteSnapshot(id); err != nil {
+		strerr := fmt.Sprintf("Failed to delete snapshot %s, whose %s is gone: %v", id, snapshotKind, err)
+		glog.V(2).Info(strerr)
+		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "SnapshotDeleteFailed", strerr)
+		return
+	}
+	glog.V(2).Infof("snapshot %s of volume %q deleted, its %s is gone", id, volume.Name, snapshotKind)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Port iSCSI portals listen on when none is given.
+const defaultISCSIPort = "3260"
+
+// Block size of fileio LUNs, the size of their files is rounded up to it.
+const fileIOBlockSize = 512
+
+// export describes local storage published as a LUN of an iSCSI target.
+type export struct {
+	// IQN of the target.
+	IQN string
+	// Name of the backstore, unique among the volumes of this provisioner.
+	Name string
+	// Path of the block device or file to publish.
+	Path string
+	// FileIO is true when Path is a regular file rather than a block device.
+	FileIO bool
+	// Size of the LUN in bytes, required for FileIO.
+	Size int64
+	// LUN number on the target.
+	Lun int32
+	// Portals the target listens on, as host or host:port.
+	Portals []string
+	// Initiator IQNs allowed to log in if ACL is true.
+	Initiators []string
+	// ACL is true if only Initiators may log in, any initiator may log in
+	// otherwise.
+	ACL bool
+	// CHAP credentials initiators have to log in with, nil for none.
+	Chap *chapCredentials
+}
+
+// targetLayer publishes local storage as iSCSI LUNs. Drivers that create
+// block devices or files use it to make them reachable by the nodes.
+type targetLayer interface {
+	// FirstLun returns the lowest LUN number volumes can be exported as.
+	FirstLun() int32
+	// Export creates the target, the backstore and the LUN of e. Exporting
+	// an existing export is not an error.
+	Export(e *export) error
+	// Unexport removes the LUN, backstore and target of e. Unexporting an
+	// export that does not exist is not an error.
+	Unexport(e *export) error
+	// SetInitiators changes the initiators allowed to log in to the target
+	// of an existing export to those of e.
+	SetInitiators(e *export) error
+	// CanResize returns an error if the LUN of e cannot report a new size
+	// of its block device, permanent if it never can. Drivers check it
+	// before they grow a volume.
+	CanResize(e *export) error
+	// Resize makes the LUN of e report the current size of its block
+	// device after it was grown.
+	Resize(e *export) error
+}
+
+// targetExporter exports the volumes of the drivers creating block devices or
+// files on the host with a target layer. Drivers embed it to implement
+// TargetExporter and InitiatorManager.
+type targetExporter struct {
+	target    targetLayer
+	iqnPrefix string
+	portals   []string
+}
+
+// newTargetExporter checks the target configuration of the given execmode and
+// returns an exporter using the given target layer.
+func newTargetExporter(execMode string, target targetLayer, config ProvisionerConfig) (targetExporter, error) {
+	if err := checkTargetConfig(execMode, config); err != nil {
+		return targetExporter{}, err
+	}
+	return targetExporter{
+		target:    target,
+		iqnPrefix: config.TargetIQNPrefix,
+		portals:   config.TargetPortals,
+	}, nil
+}
+
+func (x *targetExporter) FirstLun() int32 {
+	return x.target.FirstLun()
+}
+
+func (x *targetExporter) SetInitiators(volume *v1.PersistentVolume, initiators []string, chap *chapCredentials) error {
+	if volume.Spec.ISCSI == nil {
+		return fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	return x.target.SetInitiators(&export{
+		IQN:        volume.Spec.ISCSI.IQN,
+		Lun:        volume.Spec.ISCSI.Lun,
+		Initiators: initiators,
+		ACL:        true,
+		Chap:       chap,
+	})
+}
+
+// exportVolume exports the block device or file of e, whose Name, Path,
+// FileIO and Size are set, with the given options and returns the volume
+// with the given backend ID. The volume has no size if e has none. If the
+// export fails it is cleaned up and remove, unless it is nil, is called to
+// remove the storage of the volume.
+func (x *targetExporter) exportVolume(e *export, options VolumeOptions, backendID string, remove func() error) (*Volume, error) {
+	e.IQN, e.Lun = x.exportAddress(e.Name, options)
+	e.Portals = x.portals
+	e.Initiators = options.Initiators
+	e.ACL = options.ACL
+	e.Chap = options.Chap
+	if err := x.target.Export(e); err != nil {
+		if cleanupErr := x.target.Unexport(e); cleanupErr != nil {
+			glog.Errorf("error cleaning up export of volume %q: %v", e.Name, cleanupErr)
+		} else if remove != nil {
+			if cleanupErr := remove(); cleanupErr != nil {
+				glog.Errorf("error removing volume %q: %v", e.Name, cleanupErr)
+			}
+		}
+		return nil, err
+	}
+
+	volume := &Volume{
+		Portals:   x.portals,
+		IQN:       e.IQN,
+		Lun:       e.Lun,
+		BackendID: backendID,
+	}
+	if e.Size > 0 {
+		volume.Size = *resource.NewQuantity(e.Size, resource.BinarySI)
+	}
+	return volume, nil
+}
+
+// unexportVolume removes the LUN of the PV of a volume with the given name
+// from its target. PVs without an iSCSI source, like those standing for
+// trashed volumes, are not exported.
+func (x *targetExporter) unexportVolume(volume *v1.PersistentVolume, name string) error {
+	if volume.Spec.ISCSI == nil {
+		return nil
+	}
+	return x.target.Unexport(&export{
+		IQN:  volume.Spec.ISCSI.IQN,
+		Name: name,
+		Lun:  volume.Spec.ISCSI.Lun,
+	})
+}
+
+// unexportProvisioned removes the export an earlier attempt to provision the
+// volume with the given name and options may have left, before its PV was
+// created.
+func (x *targetExporter) unexportProvisioned(name string, options VolumeOptions) error {
+	iqn, lun := x.exportAddress(name, options)
+	return x.target.Unexport(&export{IQN: iqn, Name: name, Lun: lun})
+}
+
+// exportAddress returns the IQN and LUN the volume with the given name is
+// exported as: those the controller allocated in options, or the first LUN of
+// a target of its own.
+func (x *targetExporter) exportAddress(name string, options VolumeOptions) (string, int32) {
+	if options.Target != nil {
+		return options.Target.IQN, options.Target.Lun
+	}
+	return targetIQN(x.iqnPrefix, name), x.target.FirstLun()
+}
+
+// ensureVolume returns the size of a volume, or creates it first if size
+// returns a negative size because it does not exist. description names the
+// volume in errors.
+func ensureVolume(description string, size func() (int64, error), create func() error) (int64, error) {
+	current, err := size()
+	if err != nil || current >= 0 {
+		return current, err
+	}
+	if err := create(); err != nil {
+		return 0, err
+	}
+	if current, err = size(); err != nil {
+		return 0, err
+	}
+	if current < 0 {
+		return 0, fmt.Errorf("%s not found after creating it", description)
+	}
+	return current, nil
+}
+
+// newTargetLayer returns the target layer selected by the configuration.
+func newTargetLayer(config ProvisionerConfig) (targetLayer, error) {
+	switch config.TargetLayer {
+	case "lio":
+		return newLIOTarget(config.LIOConfigfsRoot), nil
+	case "tgt":
+		return newTgtTarget(execRunner{}), nil
+	default:
+		return nil, fmt.Errorf("unknown target-layer %q, must be lio or tgt", config.TargetLayer)
+	}
+}
+
+// checkTargetConfig checks the configuration of targets created by the given
+// execmode.
+func checkTargetConfig(execMode string, config ProvisionerConfig) error {
+	if len(config.TargetPortals) == 0 {
+		return fmt.Errorf("target-portals must be set in %s execmode", execMode)
+	}
+	if config.TargetIQNPrefix == "" {
+		return fmt.Errorf("target-iqn-prefix must be set in %s execmode", execMode)
+	}
+	return nil
+}
+
+// targetIQN returns the IQN of the target created for the given volume name.
+func targetIQN(prefix, name string) string {
+	return fmt.Sprintf("%s:%s", prefix, name)
+}
+
+// portalAddress returns portal as host:port, adding the default iSCSI port
+// if it has none.
+func portalAddress(portal string) string {
+	if _, _, err := net.SplitHostPort(portal); err == nil {
+		return portal
+	}
+	return net.JoinHostPort(strings.Trim(portal, "[]"), defaultISCSIPort)
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	testIQNPrefix = "iqn.2016-12.org.example"
+	testPortal    = "192.168.43.65"
+)
+
+// fakeTarget is a targetLayer recording the exports it is asked to create
+// and remove.
+type fakeTarget struct {
+	exported   []export
+	unexported []export
+	resized    []export
+	// exportErr is returned by Export if set.
+	exportErr error
+}
+
+func (t *fakeTarget) FirstLun() int32 {
+	return 1
+}
+
+func (t *fakeTarget) Export(e *export) error {
+	t.exported = append(t.exported, *e)
+	return t.exportErr
+}
+
+func (t *fakeTarget) Unexport(e *export) error {
+	t.unexported = append(t.unexported, *e)
+	return nil
+}
+
+func (t *fakeTarget) SetInitiators(e *export) error {
+	return nil
+}
+
+func (t *fakeTarget) CanResize(e *export) error {
+	return nil
+}
+
+func (t *fakeTarget) Resize(e *export) error {
+	t.resized = append(t.resized, *e)
+	return nil
+}
+
+// lastExport returns the export created last.
+func (t *fakeTarget) lastExport(test *testing.T) export {
+	if len(t.exported) == 0 {
+		test.Fatalf("nothing was exported")
+	}
+	return t.exported[len(t.exported)-1]
+}
+
+func newTestTargetExporter() (targetExporter, *fakeTarget) {
+	target := &fakeTarget{}
+	return targetExporter{target: target, iqnPrefix: testIQNPrefix, portals: []string{testPortal}}, target
+}
+
+func testVolumeOptions(name string, size int64, parameters map[string]string) VolumeOptions {
+	return VolumeOptions{
+		Capacity:   *resource.NewQuantity(size, resource.BinarySI),
+		PVName:     name,
+		Parameters: parameters,
+	}
+}
+
+func testISCSIVolume(name, backendID string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annBackendID: backendID},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				ISCSI: &v1.ISCSIVolumeSource{
+					TargetPortal: testPortal,
+					IQN:          targetIQN(testIQNPrefix, name),
+					Lun:          1,
+				},
+			},
+		},
+	}
+}
+
+func TestExportVolume(t *testing.T) {
+	exporter, target := newTestTargetExporter()
+	options := testVolumeOptions("pvc-1", 1<<30, nil)
+	options.Initiators = []string{testInitiatorIQN}
+	options.ACL = true
+
+	volume, err := exporter.exportVolume(&export{Name: "pvc-1", Path: "/dev/vg0/pvc-1", Size: 1 << 30}, options, "vg0/pvc-1", nil)
+	if err != nil {
+		t.Fatalf("exportVolume failed: %v", err)
+	}
+	e := target.lastExport(t)
+	if e.IQN != testIQNPrefix+":pvc-1" || e.Lun != 1 || !e.ACL || !equalStrings(e.Initiators, options.Initiators) || !equalStrings(e.Portals, []string{testPortal}) {
+		t.Errorf("unexpected export %+v", e)
+	}
+	if volume.IQN != e.IQN || volume.Lun != 1 || volume.BackendID != "vg0/pvc-1" || volume.Size.Value() != 1<<30 {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+}
+
+func TestExportVolumeAllocatedTarget(t *testing.T) {
+	exporter, target := newTestTargetExporter()
+	options := testVolumeOptions("pvc-1", 1<<30, nil)
+	options.Target = &targetLun{IQN: testTargetIQN, Lun: 7}
+
+	volume, err := exporter.exportVolume(&export{Name: "pvc-1", Path: "/dev/sdb"}, options, "pvc-1", nil)
+	if err != nil {
+		t.Fatalf("exportVolume failed: %v", err)
+	}
+	if e := target.lastExport(t); e.IQN != testTargetIQN || e.Lun != 7 {
+		t.Errorf("got export %s/%d, expected %s/7", e.IQN, e.Lun, testTargetIQN)
+	}
+	// Without a size the controller uses the requested capacity.
+	if !volume.Size.IsZero() {
+		t.Errorf("got size %s for a volume without size", volume.Size.String())
+	}
+}
+
+func TestExportVolumeFailure(t *testing.T) {
+	exporter, target := newTestTargetExporter()
+	target.exportErr = errors.New("target is down")
+	removed := false
+
+	_, err := exporter.exportVolume(&export{Name: "pvc-1", Path: "/dev/vg0/pvc-1"}, testVolumeOptions("pvc-1", 1<<30, nil), "vg0/pvc-1", func() error {
+		removed = true
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("exportVolume succeeded although Export failed")
+	}
+	if len(target.unexported) != 1 || !removed {
+		t.Errorf("the failed export was not cleaned up")
+	}
+}
+
+func TestEnsureVolume(t *testing.T) {
+	sizes := []int64{-1, 1 << 20}
+	created := 0
+	size, err := ensureVolume("volume pvc-1", func() (int64, error) {
+		size := sizes[0]
+		sizes = sizes[1:]
+		return size, nil
+	}, func() error {
+		created++
+		return nil
+	})
+	if err != nil || size != 1<<20 || created != 1 {
+		t.Errorf("got size %d, error %v and %d creations, expected 1048576, none and 1", size, err, created)
+	}
+
+	_, err = ensureVolume("volume pvc-1", func() (int64, error) {
+		return -1, nil
+	}, func() error {
+		return nil
+	})
+	if err == nil {
+		t.Errorf("ensureVolume succeeded for a volume not found after creating it")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	registerDriver("tgt", newTgtDriver)
+}
+
+func newTgtDriver(config ProvisionerConfig) (Driver, error) {
+	return newLocalDriver("tgt", newTgtTarget(execRunner{}), true, config)
+}
+
+// tgtTarget is a targetLayer configuring tgtd (scsi-target-utils) with
+// tgtadm.
+type tgtTarget struct {
+	runner commandRunner
+}
+
+func newTgtTarget(runner commandRunner) *tgtTarget {
+	return &tgtTarget{runner: runner}
+}
+
+// tgtTargetInfo is a target as listed by tgtadm.
+type tgtTargetInfo struct {
+	tid  int
+	iqn  string
+	luns []int32
+	acls []string
+	// Accounts bound to the target, outgoing ones with an " (outgoing)"
+	// suffix.
+	accounts []string
+	// Sessions of initiators logged in to the target.
+	sessions []tgtSession
+}
+
+// tgtSession is an I_T nexus of a target as listed by tgtadm.
+type tgtSession struct {
+	sid         int
+	initiator   string
+	connections []int
+}
+
+// LUN 0 of tgtd targets is the controller LUN.
+func (t *tgtTarget) FirstLun() int32 {
+	return 1
+}
+
+func (t *tgtTarget) Export(e *export) error {
+	if err := t.ensurePortals(e.Portals); err != nil {
+		return err
+	}
+
+	targets, err := t.targets()
+	if err != nil {
+		return err
+	}
+	target := findTgtTarget(targets, e.IQN)
+	if target == nil {
+		target = &tgtTargetInfo{tid: nextTgtTid(targets), iqn: e.IQN}
+		if _, err := t.tgtadm("--mode", "target", "--op", "new", "--tid", strconv.Itoa(target.tid), "--targetname", e.IQN); err != nil {
+			return err
+		}
+	}
+	tid := strconv.Itoa(target.tid)
+
+	if !containsLun(target.luns, e.Lun) {
+		args := []string{"--mode", "logicalunit", "--op", "new", "--tid", tid, "--lun", strconv.Itoa(int(e.Lun)), "--backing-store", e.Path}
+		if e.FileIO {
+			args = append(args, "--bstype", "rdwr")
+		}
+		if _, err := t.tgtadm(args...); err != nil {
+			return err
+		}
+	}
+
+	if e.Chap != nil {
+		if err := t.bindAccount(target, e.Chap.Username, e.Chap.Password, false); err != nil {
+			return err
+		}
+		if e.Chap.MutualUsername != "" {
+			if err := t.bindAccount(target, e.Chap.MutualUsername, e.Chap.MutualPassword, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return t.bindInitiators(target, e)
+}
+
+func (t *tgtTarget) SetInitiators(e *export) error {
+	targets, err := t.targets()
+	if err != nil {
+		return err
+	}
+	target := findTgtTarget(targets, e.IQN)
+	if target == nil || !containsLun(target.luns, e.Lun) {
+		return fmt.Errorf("LUN %d of tgt target %q not found", e.Lun, e.IQN)
+	}
+	return t.bindInitiators(target, e)
+}
+
+func (t *tgtTarget) Unexport(e *export) error {
+	targets, err := t.targets()
+	if err != nil {
+		return err
+	}
+	target := findTgtTarget(targets, e.IQN)
+	if target == nil {
+		return nil
+	}
+	tid := strconv.Itoa(target.tid)
+
+	if containsLun(target.luns, e.Lun) {
+		if _, err := t.tgtadm("--mode", "logicalunit", "--op", "delete", "--tid", tid, "--lun", strconv.Itoa(int(e.Lun))); err != nil {
+			return err
+		}
+	}
+	for _, lun := range target.luns {
+		if lun != 0 && lun != e.Lun {
+			// Other volumes are still exported by the target.
+			return nil
+		}
+	}
+
+	for _, acl := range target.acls {
+		if _, err := t.tgtadm("--mode", "target", "--op", "unbind", "--tid", tid, tgtInitiatorFlag(acl), acl); err != nil {
+			return err
+		}
+	}
+	if _, err := t.tgtadm("--mode", "target", "--op", "delete", "--force", "--tid", tid); err != nil {
+		return err
+	}
+	// Accounts are global, remove the ones of the removed target.
+	for _, account := range target.accounts {
+		user := strings.TrimSuffix(account, " (outgoing)")
+		if _, err := t.tgtadm("--mode", "account", "--op", "delete", "--user", user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CanResize fails, tgtd reads the size of a backing store when its LUN is
+// created only.
+func (t *tgtTarget) CanResize(e *export) error {
+	return permanentError{fmt.Errorf("tgtd cannot resize LUN %d of target %q online", e.Lun, e.IQN)}
+}
+
+func (t *tgtTarget) Resize(e *export) error {
+	return t.CanResize(e)
+}
+
+// bindInitiators binds the initiators allowed to log in by e to a target, or
+// ALL if e has no ACL, and unbinds all others.
+func (t *tgtTarget) bindInitiators(target *tgtTargetInfo, e *export) error {
+	tid := strconv.Itoa(target.tid)
+	allowed := []string{"ALL"}
+	if e.ACL {
+		allowed = e.Initiators
+	}
+	for _, acl := range target.acls {
+		if containsString(allowed, acl) {
+			continue
+		}
+		if _, err := t.tgtadm("--mode", "target", "--op", "unbind", "--tid", tid, tgtInitiatorFlag(acl), acl); err != nil {
+			return err
+		}
+	}
+	for _, initiator := range allowed {
+		if containsString(target.acls, initiator) {
+			continue
+		}
+		if _, err := t.tgtadm("--mode", "target", "--op", "bind", "--tid", tid, tgtInitiatorFlag(initiator), initiator); err != nil {
+			return err
+		}
+	}
+	if !e.ACL {
+		return nil
+	}
+	// Unbinding an initiator only keeps it from logging in again, close
+	// the connections it has.
+	for _, session := range target.sessions {
+		if containsString(allowed, session.initiator) {
+			continue
+		}
+		glog.V(3).Infof("closing session %d of initiator %q to tgt target %q", session.sid, session.initiator, target.iqn)
+		for _, cid := range session.connections {
+			if _, err := t.tgtadm("--mode", "conn", "--op", "delete", "--tid", tid, "--sid", strconv.Itoa(session.sid), "--cid", strconv.Itoa(cid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tgtInitiatorFlag returns the tgtadm flag binding the given ACL entry, an
+// initiator name or an address.
+func tgtInitiatorFlag(acl string) string {
+	if strings.HasPrefix(acl, "iqn.") || strings.HasPrefix(acl, "eui.") || strings.HasPrefix(acl, "naa.") {
+		return "--initiator-name"
+	}
+	return "--initiator-address"
+}
+
+// bindAccount creates a CHAP account with the given password and binds it to
+// a target. Outgoing accounts are used for mutual CHAP. tgtadm cannot change
+// the password of an account, an existing account is recreated as it may
+// have been created with another password.
+func (t *tgtTarget) bindAccount(target *tgtTargetInfo, user, password string, outgoing bool) error {
+	out, err := t.tgtadm("--mode", "account", "--op", "show")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != user {
+			continue
+		}
+		// Deleting an account unbinds it from its targets.
+		if _, err := t.tgtadm("--mode", "account", "--op", "delete", "--user", user); err != nil {
+			return err
+		}
+		break
+	}
+	if _, err := t.tgtadm("--mode", "account", "--op", "new", "--user", user, "--password", password); err != nil {
+		return err
+	}
+
+	args := []string{"--mode", "account", "--op", "bind", "--tid", strconv.Itoa(target.tid), "--user", user}
+	if outgoing {
+		args = append(args, "--outgoing")
+	}
+	_, err = t.tgtadm(args...)
+	return err
+}
+
+// ensurePortals makes tgtd listen on the given portals.
+func (t *tgtTarget) ensurePortals(portals []string) error {
+	out, err := t.tgtadm("--mode", "portal", "--op", "show")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Portal:") {
+			portal := strings.TrimSpace(strings.TrimPrefix(line, "Portal:"))
+			// Strip the portal group tag.
+			if i := strings.LastIndex(portal, ","); i >= 0 {
+				portal = portal[:i]
+			}
+			existing[portal] = true
+		}
+	}
+	for _, portal := range portals {
+		address := portalAddress(portal)
+		if existing[address] {
+			continue
+		}
+		if _, err := t.tgtadm("--mode", "portal", "--op", "new", "--param", "portal="+address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targets lists the targets of tgtd.
+func (t *tgtTarget) targets() ([]tgtTargetInfo, error) {
+	out, err := t.tgtadm("--mode", "target", "--op", "show")
+	if err != nil {
+		return nil, err
+	}
+	return parseTgtTargets(out)
+}
+
+func (t *tgtTarget) tgtadm(args ...string) ([]byte, error) {
+	return t.runner.Run("tgtadm", append([]string{"--lld", "iscsi"}, args...)...)
+}
+
+// parseTgtTargets parses the output of `tgtadm --mode target --op show`:
+//
+//	Target 1: iqn.2016-12.org.kubernetes:pvc-1
+//	    System information:
+//	    ...
+//	    I_T nexus information:
+//	        I_T nexus: 3
+//	            Initiator: iqn.1994-05.com.redhat:node1 alias: node1
+//	            Connection: 0
+//	                IP Address: 192.168.0.2
+//	    LUN information:
+//	        LUN: 0
+//	        ...
+//	    ACL information:
+//	        ALL
+func parseTgtTargets(out []byte) ([]tgtTargetInfo, error) {
+	var targets []tgtTargetInfo
+	var target *tgtTargetInfo
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Target "):
+			fields := strings.SplitN(strings.TrimPrefix(line, "Target "), ":", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("cannot parse tgtadm output line %q", line)
+			}
+			tid, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse tgtadm output line %q: %v", line, err)
+			}
+			targets = append(targets, tgtTargetInfo{tid: tid, iqn: strings.TrimSpace(fields[1])})
+			target = &targets[len(targets)-1]
+			section = ""
+		case target == nil || trimmed == "":
+		case strings.HasSuffix(trimmed, "information:"):
+			section = trimmed
+		case section == "LUN information:" && strings.HasPrefix(trimmed, "LUN:"):
+			lun, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(trimmed, "LUN:")))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse tgtadm output line %q: %v", line, err)
+			}
+			target.luns = append(target.luns, int32(lun))
+		case section == "I_T nexus information:" && strings.HasPrefix(trimmed, "I_T nexus:"):
+			sid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(trimmed, "I_T nexus:")))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse tgtadm output line %q: %v", line, err)
+			}
+			target.sessions = append(target.sessions, tgtSession{sid: sid})
+		case section == "I_T nexus information:" && len(target.sessions) > 0 && strings.HasPrefix(trimmed, "Initiator:"):
+			if fields := strings.Fields(strings.TrimPrefix(trimmed, "Initiator:")); len(fields) > 0 {
+				target.sessions[len(target.sessions)-1].initiator = fields[0]
+			}
+		case section == "I_T nexus information:" && len(target.sessions) > 0 && strings.HasPrefix(trimmed, "Connection:"):
+			cid, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(trimmed, "Connection:")))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse tgtadm output line %q: %v", line, err)
+			}
+			session := &target.sessions[len(target.sessions)-1]
+			session.connections = append(session.connections, cid)
+		case section == "ACL information:":
+			target.acls = append(target.acls, trimmed)
+		case section == "Account information:":
+			target.accounts = append(target.accounts, trimmed)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+func findTgtTarget(targets []tgtTargetInfo, iqn string) *tgtTargetInfo {
+	for i := range targets {
+		if targets[i].iqn == iqn {
+			return &targets[i]
+		}
+	}
+	return nil
+}
+
+// nextTgtTid returns the lowest target ID not in use.
+func nextTgtTid(targets []tgtTargetInfo) int {
+	used := make(map[int]bool)
+	for _, target := range targets {
+		used[target.tid] = true
+	}
+	tid := 1
+	for used[tid] {
+		tid++
+	}
+	return tid
+}
+
+func containsLun(luns []int32, lun int32) bool {
+	for _, l := range luns {
+		if l == lun {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
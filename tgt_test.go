@@ -0,0 +1,266 @@
+package main
+
+import (
+	"testing"
+)
+
+const testTgtTargets = `Target 1: iqn.2016-12.org.example:pvc-1
+    System information:
+        Driver: iscsi
+        State: ready
+    I_T nexus information:
+        I_T nexus: 3
+            Initiator: iqn.2016-12.org.example:node1 alias: node1
+            Connection: 0
+                IP Address: 192.168.43.10
+        I_T nexus: 4
+            Initiator: iqn.2016-12.org.example:node2 alias: node2
+            Connection: 0
+                IP Address: 192.168.43.11
+            Connection: 1
+                IP Address: 192.168.44.11
+    LUN information:
+        LUN: 0
+            Type: controller
+            Backing store path: None
+        LUN: 1
+            Type: disk
+            Size: 1074 MB, Block size: 512
+            Backing store path: /dev/vg0/pvc-1
+    Account information:
+        user1
+        target1 (outgoing)
+    ACL information:
+        iqn.2016-12.org.example:node1
+        iqn.2016-12.org.example:node2
+Target 3: iqn.2016-12.org.example:pvc-3
+    System information:
+        Driver: iscsi
+        State: ready
+    I_T nexus information:
+    LUN information:
+        LUN: 0
+            Type: controller
+    Account information:
+    ACL information:
+        ALL
+`
+
+const (
+	testTgtIQN   = "iqn.2016-12.org.example:pvc-1"
+	testTgtNode1 = "iqn.2016-12.org.example:node1"
+	testTgtNode2 = "iqn.2016-12.org.example:node2"
+)
+
+func TestParseTgtTargets(t *testing.T) {
+	targets, err := parseTgtTargets([]byte(testTgtTargets))
+	if err != nil {
+		t.Fatalf("parseTgtTargets failed: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, expected 2", len(targets))
+	}
+	target := targets[0]
+	if target.tid != 1 || target.iqn != testTgtIQN {
+		t.Errorf("got target %d %q", target.tid, target.iqn)
+	}
+	if len(target.luns) != 2 || target.luns[0] != 0 || target.luns[1] != 1 {
+		t.Errorf("got LUNs %v, expected [0 1]", target.luns)
+	}
+	if !equalStrings(target.acls, []string{testTgtNode1, testTgtNode2}) {
+		t.Errorf("got ACLs %v", target.acls)
+	}
+	if !equalStrings(target.accounts, []string{"user1", "target1 (outgoing)"}) {
+		t.Errorf("got accounts %v", target.accounts)
+	}
+	if len(target.sessions) != 2 {
+		t.Fatalf("got %d sessions, expected 2", len(target.sessions))
+	}
+	session := target.sessions[1]
+	if session.sid != 4 || session.initiator != testTgtNode2 || len(session.connections) != 2 || session.connections[1] != 1 {
+		t.Errorf("unexpected session %+v", session)
+	}
+
+	if targets[1].tid != 3 || len(targets[1].sessions) != 0 || !equalStrings(targets[1].acls, []string{"ALL"}) {
+		t.Errorf("unexpected target %+v", targets[1])
+	}
+	if tid := nextTgtTid(targets); tid != 2 {
+		t.Errorf("got next tid %d, expected 2", tid)
+	}
+}
+
+func TestParseTgtTargetsInvalid(t *testing.T) {
+	if _, err := parseTgtTargets([]byte("Target x: iqn.2016-12.org.example:pvc-1\n")); err == nil {
+		t.Errorf("parseTgtTargets succeeded for an invalid target ID")
+	}
+}
+
+func TestTgtExportNewTarget(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	err := target.Export(&export{
+		IQN:     "iqn.2016-12.org.example:pvc-2",
+		Path:    "/var/lib/iscsi-provisioner/pvc-2.img",
+		FileIO:  true,
+		Lun:     1,
+		Portals: []string{"192.168.43.65"},
+	})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode portal --op show",
+		"tgtadm --lld iscsi --mode portal --op new --param portal=192.168.43.65:3260",
+		"tgtadm --lld iscsi --mode target --op show",
+		"tgtadm --lld iscsi --mode target --op new --tid 2 --targetname iqn.2016-12.org.example:pvc-2",
+		"tgtadm --lld iscsi --mode logicalunit --op new --tid 2 --lun 1 --backing-store /var/lib/iscsi-provisioner/pvc-2.img --bstype rdwr",
+		"tgtadm --lld iscsi --mode target --op bind --tid 2 --initiator-address ALL",
+	)
+}
+
+func TestTgtExportExisting(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode portal --op show", "Portal: 192.168.43.65:3260,1\n")
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	err := target.Export(&export{
+		IQN:        testTgtIQN,
+		Path:       "/dev/vg0/pvc-1",
+		Lun:        1,
+		Portals:    []string{"192.168.43.65"},
+		Initiators: []string{testTgtNode1, testTgtNode2},
+		ACL:        true,
+	})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode portal --op show",
+		"tgtadm --lld iscsi --mode target --op show",
+	)
+}
+
+func TestTgtExportChap(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	runner.respond("tgtadm --lld iscsi --mode account --op show", "Account list:\n    user1\n    target1\n")
+	target := newTgtTarget(runner)
+
+	err := target.Export(&export{
+		IQN:        testTgtIQN,
+		Path:       "/dev/vg0/pvc-1",
+		Lun:        1,
+		Initiators: []string{testTgtNode1, testTgtNode2},
+		ACL:        true,
+		Chap:       &chapCredentials{Username: "user1", Password: "new", MutualUsername: "target2", MutualPassword: "mutual"},
+	})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	// The existing account is recreated with the new password.
+	runner.checkCommands(t, "tgtadm --lld iscsi --mode account",
+		"tgtadm --lld iscsi --mode account --op show",
+		"tgtadm --lld iscsi --mode account --op delete --user user1",
+		"tgtadm --lld iscsi --mode account --op new --user user1 --password new",
+		"tgtadm --lld iscsi --mode account --op bind --tid 1 --user user1",
+		"tgtadm --lld iscsi --mode account --op show",
+		"tgtadm --lld iscsi --mode account --op new --user target2 --password mutual",
+		"tgtadm --lld iscsi --mode account --op bind --tid 1 --user target2 --outgoing",
+	)
+}
+
+func TestTgtSetInitiators(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	err := target.SetInitiators(&export{
+		IQN:        testTgtIQN,
+		Lun:        1,
+		Initiators: []string{testTgtNode1, "iqn.2016-12.org.example:node3"},
+		ACL:        true,
+	})
+	if err != nil {
+		t.Fatalf("SetInitiators failed: %v", err)
+	}
+	// node2 is unbound and its connections are closed.
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode target --op show",
+		"tgtadm --lld iscsi --mode target --op unbind --tid 1 --initiator-name iqn.2016-12.org.example:node2",
+		"tgtadm --lld iscsi --mode target --op bind --tid 1 --initiator-name iqn.2016-12.org.example:node3",
+		"tgtadm --lld iscsi --mode conn --op delete --tid 1 --sid 4 --cid 0",
+		"tgtadm --lld iscsi --mode conn --op delete --tid 1 --sid 4 --cid 1",
+	)
+}
+
+func TestTgtSetInitiatorsNotFound(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	if err := target.SetInitiators(&export{IQN: testTgtIQN, Lun: 2, ACL: true}); err == nil {
+		t.Errorf("SetInitiators succeeded for a LUN that does not exist")
+	}
+}
+
+func TestTgtUnexport(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	if err := target.Unexport(&export{IQN: testTgtIQN, Lun: 1}); err != nil {
+		t.Fatalf("Unexport failed: %v", err)
+	}
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode target --op show",
+		"tgtadm --lld iscsi --mode logicalunit --op delete --tid 1 --lun 1",
+		"tgtadm --lld iscsi --mode target --op unbind --tid 1 --initiator-name iqn.2016-12.org.example:node1",
+		"tgtadm --lld iscsi --mode target --op unbind --tid 1 --initiator-name iqn.2016-12.org.example:node2",
+		"tgtadm --lld iscsi --mode target --op delete --force --tid 1",
+		"tgtadm --lld iscsi --mode account --op delete --user user1",
+		"tgtadm --lld iscsi --mode account --op delete --user target1",
+	)
+}
+
+func TestTgtUnexportSharedTarget(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	// LUN 1 is still exported, the target is kept.
+	if err := target.Unexport(&export{IQN: testTgtIQN, Lun: 2}); err != nil {
+		t.Fatalf("Unexport failed: %v", err)
+	}
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode target --op show",
+	)
+}
+
+func TestTgtUnexportNotFound(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond("tgtadm --lld iscsi --mode target --op show", testTgtTargets)
+	target := newTgtTarget(runner)
+
+	if err := target.Unexport(&export{IQN: "iqn.2016-12.org.example:gone", Lun: 1}); err != nil {
+		t.Fatalf("Unexport failed: %v", err)
+	}
+	runner.checkCommands(t, "tgtadm",
+		"tgtadm --lld iscsi --mode target --op show",
+	)
+}
+
+func TestTgtErrors(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.fail("tgtadm --lld iscsi --mode target --op show", "tgtd is not running")
+	target := newTgtTarget(runner)
+
+	if err := target.Export(&export{IQN: testTgtIQN, Lun: 1}); err == nil {
+		t.Errorf("Export succeeded without tgtd")
+	}
+	if err := target.CanResize(&export{IQN: testTgtIQN, Lun: 1}); err == nil || isTemporary(err) {
+		t.Errorf("got %v, expected a permanent error", err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	apierrs "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Volumes of classes with the trashRetention parameter are moved to the trash
+// of their backend when their PV is deleted instead of being deleted. The
+// trash inventory, a ConfigMap, lists the trashed volumes by the name of
+// their PV. They are purged once their retention is over, until then a claim
+// in the namespace of their old claim can get them back with the
+// annRestoreFromTrash annotation.
+
+// This annotation is added to the PVs of classes with the trashRetention
+// parameter and holds the retention.
+const annTrashRetention = "iscsi-provisioner/trash-retention"
+
+// This annotation can be set on a claim to provision it with the trashed
+// volume of the named PV.
+const annRestoreFromTrash = "iscsi-provisioner/restore-from-trash"
+
+// Interval between checks for trashed volumes to purge.
+const trashPurgeInterval = time.Minute
+
+// trashEntry describes a trashed volume in the trash inventory.
+type trashEntry struct {
+	// ID of the volume in the trash of the driver.
+	ID string `json:"id"`
+	// Provisioner and execmode that trashed the volume.
+	Provisioner string `json:"provisioner"`
+	ExecMode    string `json:"execMode"`
+	// StorageClass of the PV.
+	StorageClass string `json:"storageClass"`
+	// Namespace and name of the claim the PV was bound to.
+	ClaimNamespace string `json:"claimNamespace"`
+	ClaimName      string `json:"claimName"`
+	// Capacity of the PV in bytes.
+	SizeBytes int64 `json:"sizeBytes"`
+	// When the volume was trashed and when it is purged.
+	TrashedAt unversioned.Time `json:"trashedAt"`
+	PurgeAt   unversioned.Time `json:"purgeAt"`
+	// Wipe policy of the PV, the volume is wiped before it is purged.
+	WipePolicy string `json:"wipePolicy,omitempty"`
+	// WipeError is set if the volume could not be wiped, it is not purged
+	// until an admin removes it.
+	WipeError string `json:"wipeError,omitempty"`
+}
+
+// trashRetention returns how long the volume of a PV is kept in the trash
+// when it is deleted, 0 if it is deleted right away.
+func trashRetention(volume *v1.PersistentVolume) time.Duration {
+	value, found := volume.Annotations[annTrashRetention]
+	if !found {
+		return 0
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		glog.V(3).Infof("ignoring invalid %s annotation %q of volume %q", annTrashRetention, value, volume.Name)
+		return 0
+	}
+	return retention
+}
+
+// trashOperationName returns the name of the operations purging or restoring
+// the trashed volume of the given PV, which must not run concurrently.
+func trashOperationName(pvName string) string {
+	return "trash-" + pvName
+}
+
+// trashInventory returns the namespace and name of the trash inventory.
+func (ctrl *iscsiController) trashInventory() (string, string) {
+	return splitConfigMapRef(ctrl.provisionerConfig.TrashInventory)
+}
+
+// getTrashEntries returns the entries of the trash inventory by PV name.
+func (ctrl *iscsiController) getTrashEntries() (map[string]*trashEntry, error) {
+	namespace, name := ctrl.trashInventory()
+	configMap, err := ctrl.client.Core().ConfigMaps(namespace).Get(name)
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading trash inventory %s/%s: %v", namespace, name, err)
+	}
+	entries := make(map[string]*trashEntry)
+	for pvName, value := range configMap.Data {
+		entry := &trashEntry{}
+		if err := json.Unmarshal([]byte(value), entry); err != nil {
+			glog.Errorf("ignoring invalid entry %q of trash inventory %s/%s: %v", pvName, namespace, name, err)
+			continue
+		}
+		entries[pvName] = entry
+	}
+	return entries, nil
+}
+
+// updateTrashEntry sets the trash inventory entry of the given PV, or removes
+// it if entry is nil. A removed entry is only removed if it still has the
+// given ID.
+func (ctrl *iscsiController) updateTrashEntry(pvName, id string, entry *trashEntry) error {
+	var data string
+	if entry != nil {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = string(value)
+	}
+	namespace, name := ctrl.trashInventory()
+	err := ctrl.updateConfigMap(namespace, name, func(entries map[string]string) bool {
+		if entry != nil {
+			entries[pvName] = data
+			return true
+		}
+		current := &trashEntry{}
+		value, found := entries[pvName]
+		if !found || (json.Unmarshal([]byte(value), current) == nil && current.ID != id) {
+			return false
+		}
+		delete(entries, pvName)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error updating trash inventory %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// trashVolume moves the volume of a deleted PV to the trash and records it in
+// the trash inventory.
+func (ctrl *iscsiController) trashVolume(volume *v1.PersistentVolume, retention time.Duration) error {
+	trasher, ok := ctrl.driver.(Trasher)
+	if !ok {
+		return fmt.Errorf("the %s execmode has no trash", ctrl.provisionerConfig.Opmode)
+	}
+	id, err := trasher.Trash(volume)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	entry := &trashEntry{
+		ID:           id,
+		Provisioner:  ctrl.provisionerName,
+		ExecMode:     ctrl.provisionerConfig.Opmode,
+		StorageClass: volume.Annotations[annClass],
+		SizeBytes:    capacity.Value(),
+		WipePolicy:   volume.Annotations[annWipePolicy],
+		TrashedAt:    unversioned.NewTime(now),
+		PurgeAt:      unversioned.NewTime(now.Add(retention)),
+	}
+	if volume.Spec.ClaimRef != nil {
+		entry.ClaimNamespace = volume.Spec.ClaimRef.Namespace
+		entry.ClaimName = volume.Spec.ClaimRef.Name
+	}
+	// The volume is trashed again on retry, which returns the same ID.
+	if err := ctrl.updateTrashEntry(volume.Name, id, entry); err != nil {
+		return err
+	}
+	if err := ctrl.deleteChapSecret(volume); err != nil {
+		return err
+	}
+	glog.V(2).Infof("volume %q moved to the trash as %s until %v", volume.Name, id, entry.PurgeAt)
+	ctrl.eventRecorder.Event(volume, v1.EventTypeNormal, "VolumeTrashed", fmt.Sprintf("Moved volume to the trash as %s, it is purged after %v", id, entry.PurgeAt))
+	return nil
+}
+
+// getTrashedVolume returns the trash inventory entry of the volume a claim of
+// the given class is restored from, nil if it is not restored. Errors that do
+// not go away on retry are permanent.
+func (ctrl *iscsiController) getTrashedVolume(claim *v1.PersistentVolumeClaim, class string) (*trashEntry, error) {
+	pvName, found := claim.Annotations[annRestoreFromTrash]
+	if !found {
+		return nil, nil
+	}
+	if _, ok := ctrl.driver.(Trasher); !ok {
+		return nil, permanentError{fmt.Errorf("the %s execmode has no trash", ctrl.provisionerConfig.Opmode)}
+	}
+	entries, err := ctrl.getTrashEntries()
+	if err != nil {
+		return nil, err
+	}
+	entry, found := entries[pvName]
+	if !found || entry.Provisioner != ctrl.provisionerName || entry.ExecMode != ctrl.provisionerConfig.Opmode {
+		return nil, permanentError{fmt.Errorf("volume %q is not in the trash", pvName)}
+	}
+	// Only the owner of the data may get it back.
+	if entry.ClaimNamespace != claim.Namespace {
+		return nil, permanentError{fmt.Errorf("volume %q was not trashed from namespace %s", pvName, claim.Namespace)}
+	}
+	if entry.StorageClass != class {
+		return nil, permanentError{fmt.Errorf("volume %q has StorageClass %q, not %q", pvName, entry.StorageClass, class)}
+	}
+	if !time.Now().Before(entry.PurgeAt.Time) {
+		return nil, permanentError{fmt.Errorf("the retention of volume %q in the trash ended at %v", pvName, entry.PurgeAt)}
+	}
+	return entry, nil
+}
+
+// restoredVolume removes the entry of a trashed PV whose volume was restored
+// from the trash inventory.
+func (ctrl *iscsiController) restoredVolume(pvName string, entry *trashEntry, claim *v1.PersistentVolumeClaim) {
+	if err := ctrl.updateTrashEntry(pvName, entry.ID, nil); err != nil {
+		// Purging a restored volume finds nothing and removes the
+		// entry.
+		glog.Errorf("failed to remove restored volume %q from the trash inventory: %v", pvName, err)
+	}
+	ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "VolumeRestored", fmt.Sprintf("Restored volume %s from the trash", pvName))
+}
+
+// retrashVolume moves a restored volume whose PV could not be created back to
+// the trash, as the trashed volume of the given PV.
+func (ctrl *iscsiController) retrashVolume(pvName string, entry *trashEntry, volume *v1.PersistentVolume) error {
+	id, err := ctrl.driver.(Trasher).Trash(volume)
+	if err != nil {
+		return err
+	}
+	retrashed := *entry
+	retrashed.ID = id
+	if err := ctrl.updateTrashEntry(pvName, id, &retrashed); err != nil {
+		return err
+	}
+	return ctrl.deleteChapSecret(volume)
+}
+
+// shouldPurge returns true if a trashed volume is ours and its retention is
+// over.
+func (ctrl *iscsiController) shouldPurge(entry *trashEntry) bool {
+	return entry.Provisioner == ctrl.provisionerName && entry.ExecMode == ctrl.provisionerConfig.Opmode && !time.Now().Before(entry.PurgeAt.Time)
+}
+
+// purgeTrash schedules purgeTrashOperation for the trashed volumes whose
+// retention is over.
+func (ctrl *iscsiController) purgeTrash() {
+	entries, err := ctrl.getTrashEntries()
+	if err != nil {
+		glog.Errorf("failed to purge the trash: %v", err)
+		return
+	}
+	pvNames := make([]string, 0, len(entries))
+	for pvName := range entries {
+		pvNames = append(pvNames, pvName)
+	}
+	sort.Strings(pvNames)
+
+	for _, pvName := range pvNames {
+		entry := entries[pvName]
+		if !ctrl.shouldPurge(entry) {
+			continue
+		}
+		if entry.WipeError != "" {
+			glog.V(4).Infof("not purging trashed volume %s of PV %q, it could not be wiped: %s", entry.ID, pvName, entry.WipeError)
+			continue
+		}
+		pvName := pvName
+		ctrl.scheduleOperation(trashOperationName(pvName), func() error {
+			ctrl.purgeTrashOperation(pvName)
+			return nil
+		})
+	}
+}
+
+// purgeTrashOperation wipes and purges the trashed volume of a PV and removes
+// it from the trash inventory.
+func (ctrl *iscsiController) purgeTrashOperation(pvName string) {
+	glog.V(4).Infof("purgeTrashOperation [%s] started", pvName)
+
+	// The volume may have been purged or restored while we were waiting.
+	entries, err := ctrl.getTrashEntries()
+	if err != nil {
+		glog.Errorf("failed to purge trashed volume of PV %q: %v", pvName, err)
+		return
+	}
+	entry, found := entries[pvName]
+	if !found || !ctrl.shouldPurge(entry) || entry.WipeError != "" {
+		glog.V(3).Infof("trashed volume of PV %q no longer needs purging, skipping", pvName)
+		return
+	}
+	if !ctrl.wipeTrashedVolume(pvName, entry) {
+		return
+	}
+	if err := ctrl.driver.(Trasher).Purge(entry.ID); err != nil {
+		glog.Errorf("failed to purge trashed volume %s of PV %q: %v", entry.ID, pvName, err)
+		return
+	}
+	if err := ctrl.updateTrashEntry(pvName, entry.ID, nil); err != nil {
+		glog.Errorf("failed to remove purged volume %q from the trash inventory: %v", pvName, err)
+		return
+	}
+	glog.V(2).Infof("trashed volume %s of PV %q purged", entry.ID, pvName)
+}
+
+// wipeTrashedVolume wipes a trashed volume with the wipe policy of its PV and
+// returns true if it may be purged. If wiping fails the error is recorded in
+// the trash inventory.
+func (ctrl *iscsiController) wipeTrashedVolume(pvName string, entry *trashEntry) bool {
+	policy := entry.WipePolicy
+	if policy == "" || policy == wipePolicyNone {
+		return true
+	}
+	err := ctrl.checkWipePolicy(policy)
+	if err == nil {
+		glog.V(3).Infof("wiping trashed volume %s of PV %q with policy %s", entry.ID, pvName, policy)
+		err = ctrl.driver.(Wiper).Wipe(trashedVolume(pvName, entry.ID), policy)
+	}
+	if err == nil {
+		return true
+	}
+	glog.Errorf("failed to wipe trashed volume %s of PV %q with policy %s: %v", entry.ID, pvName, policy, err)
+	failed := *entry
+	failed.WipeError = err.Error()
+	if err := ctrl.updateTrashEntry(pvName, entry.ID, &failed); err != nil {
+		glog.Errorf("failed to record wipe error of trashed volume %s: %v", entry.ID, err)
+	}
+	return false
+}
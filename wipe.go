@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Wipe policies of the wipePolicy StorageClass parameter, how the data of a
+// volume is erased before the volume is deleted.
+const (
+	// The data is left as is.
+	wipePolicyNone = "none"
+	// The blocks of the volume are discarded.
+	wipePolicyDiscard = "discard"
+	// Zeroes are written over the whole volume.
+	wipePolicyZeroFill = "zero-fill"
+	// The key the volume is encrypted with is destroyed.
+	wipePolicyCryptoErase = "crypto-erase"
+)
+
+var wipePolicies = []string{wipePolicyNone, wipePolicyDiscard, wipePolicyZeroFill, wipePolicyCryptoErase}
+
+// This annotation is added to the PVs of classes with a wipe policy other
+// than none and holds the policy.
+const annWipePolicy = "iscsi-provisioner/wipe-policy"
+
+// This annotation is added to a PV whose volume could not be wiped and holds
+// the error. The volume is not deleted until an admin removes it.
+const annWipeFailed = "iscsi-provisioner/wipe-failed"
+
+// wipePolicy returns the wipe policy of a PV.
+func wipePolicy(volume *v1.PersistentVolume) string {
+	if policy := volume.Annotations[annWipePolicy]; policy != "" {
+		return policy
+	}
+	return wipePolicyNone
+}
+
+// checkWipePolicy returns an error if the driver cannot wipe volumes with the
+// given policy.
+func (ctrl *iscsiController) checkWipePolicy(policy string) error {
+	if policy == wipePolicyNone {
+		return nil
+	}
+	if wiper, ok := ctrl.driver.(Wiper); ok && wiper.CanWipe(policy) {
+		return nil
+	}
+	return fmt.Errorf("%s %s is not supported in %s execmode", paramWipePolicy, policy, ctrl.provisionerConfig.Opmode)
+}
+
+// wipeVolume wipes the volume of a released PV with its wipe policy and
+// returns true if it may be deleted. If wiping fails the PV is marked as
+// failed and kept.
+func (ctrl *iscsiController) wipeVolume(volume *v1.PersistentVolume) bool {
+	policy := wipePolicy(volume)
+	if policy == wipePolicyNone {
+		return true
+	}
+	err := ctrl.checkWipePolicy(policy)
+	if err == nil {
+		glog.V(3).Infof("wiping volume %q with policy %s", volume.Name, policy)
+		ctrl.eventRecorder.Event(volume, v1.EventTypeNormal, "VolumeWiping", fmt.Sprintf("Wiping volume with policy %s", policy))
+		err = ctrl.driver.(Wiper).Wipe(volume, policy)
+	}
+	if err != nil {
+		ctrl.setWipeFailed(volume, policy, err)
+		return false
+	}
+	glog.V(2).Infof("volume %q wiped with policy %s", volume.Name, policy)
+	ctrl.eventRecorder.Event(volume, v1.EventTypeNormal, "VolumeWiped", fmt.Sprintf("Wiped volume with policy %s", policy))
+	return true
+}
+
+// setWipeFailed keeps a PV whose volume could not be wiped from being
+// deleted and sets its phase to Failed.
+func (ctrl *iscsiController) setWipeFailed(volume *v1.PersistentVolume, policy string, wipeErr error) {
+	strerr := fmt.Sprintf("Failed to wipe volume with policy %s: %v. The volume is kept until the %s annotation is removed.", policy, wipeErr, annWipeFailed)
+	glog.Errorf("volume %q: %s", volume.Name, strerr)
+	ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeWipeFailed", strerr)
+
+	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
+	if err != nil {
+		glog.V(3).Infof("error reading peristent volume %q: %v", volume.Name, err)
+		return
+	}
+	setAnnotation(&newVolume.ObjectMeta, annWipeFailed, wipeErr.Error())
+	if newVolume, err = ctrl.client.Core().PersistentVolumes().Update(newVolume); err != nil {
+		glog.V(3).Infof("failed to mark volume %q as not wiped: %v", volume.Name, err)
+		return
+	}
+	newVolume.Status.Phase = v1.VolumeFailed
+	newVolume.Status.Message = strerr
+	if _, err = ctrl.client.Core().PersistentVolumes().UpdateStatus(newVolume); err != nil {
+		glog.V(3).Infof("failed to set phase of volume %q to %s: %v", volume.Name, v1.VolumeFailed, err)
+	}
+}
+
+// trashedVolume returns a PV standing for the trashed volume with the given
+// ID, for drivers to wipe it.
+func trashedVolume(pvName, id string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        pvName,
+			Annotations: map[string]string{annBackendID: id},
+		},
+	}
+}
+
+// wipeDevice wipes a block device with the given policy, discard or
+// zero-fill.
+func wipeDevice(runner commandRunner, path, policy string) error {
+	var err error
+	switch policy {
+	case wipePolicyDiscard:
+		_, err = runner.Run("blkdiscard", path)
+	case wipePolicyZeroFill:
+		_, err = runner.Run("blkdiscard", "--zeroout", path)
+	default:
+		err = fmt.Errorf("unsupported wipe policy %s", policy)
+	}
+	return err
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func init() {
+	registerDriver("zfs", newZFSDriver)
+}
+
+// StorageClass parameters of the zfs execmode.
+const (
+	// Dataset to create zvols in, e.g. "tank/kubernetes", required.
+	zfsParamParent = "parentDataset"
+	// Block size of the zvols, e.g. "16K".
+	zfsParamVolBlockSize = "volblocksize"
+	// Compression of the zvols, e.g. "lz4" or "off".
+	zfsParamCompression = "compression"
+	// "true" to create sparse zvols without a reservation.
+	zfsParamSparse = "sparse"
+)
+
+// Sizes of zvols without volblocksize parameter are rounded up to this, a
+// multiple of any default volblocksize.
+const zfsDefaultSizeGranularity = 128 * 1024
+
+// Prefix of the names of zvols in the trash.
+const zfsTrashPrefix = "trash-"
+
+// zfs creates and destroys zvols with the zfs command.
+type zfs struct {
+	runner commandRunner
+}
+
+// createVolume creates a zvol of the given size. Options are set as
+// properties of the zvol, in the order of their names.
+func (z *zfs) createVolume(dataset string, size int64, sparse bool, options map[string]string) error {
+	args := []string{"create"}
+	if sparse {
+		args = append(args, "-s")
+	}
+	args = append(args, "-V", strconv.FormatInt(size, 10))
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-o", name+"="+options[name])
+	}
+	_, err := z.runner.Run("zfs", append(args, dataset)...)
+	return err
+}
+
+// createSnapshot creates a snapshot of a zvol.
+func (z *zfs) createSnapshot(snapshot string) error {
+	_, err := z.runner.Run("zfs", "snapshot", snapshot)
+	return err
+}
+
+// snapshotInfo returns the size of the zvol when a snapshot was taken and its
+// creation time, or -1 if the snapshot does not exist.
+func (z *zfs) snapshotInfo(snapshot string) (int64, time.Time, error) {
+	out, err := z.runner.Run("zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,volsize,creation", "-d", "1", strings.SplitN(snapshot, "@", 2)[0])
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != snapshot {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("cannot parse size of snapshot %s: %v", snapshot, err)
+		}
+		creation, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("cannot parse creation time of snapshot %s: %v", snapshot, err)
+		}
+		return size, time.Unix(creation, 0), nil
+	}
+	return -1, time.Time{}, nil
+}
+
+// snapshots returns the names of the snapshots of a zvol.
+func (z *zfs) snapshots(dataset string) ([]string, error) {
+	out, err := z.runner.Run("zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", dataset)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// setVolumeSize grows a zvol to the given size.
+func (z *zfs) setVolumeSize(dataset string, size int64) error {
+	return z.setProperty(dataset, "volsize", strconv.FormatInt(size, 10))
+}
+
+// setProperty sets a property of a zvol.
+func (z *zfs) setProperty(dataset, name, value string) error {
+	_, err := z.runner.Run("zfs", "set", name+"="+value, dataset)
+	return err
+}
+
+// blockSize returns the volblocksize of a zvol in bytes.
+func (z *zfs) blockSize(dataset string) (int64, error) {
+	out, err := z.runner.Run("zfs", "get", "-H", "-p", "-o", "value", "volblocksize", dataset)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("cannot parse volblocksize of zvol %s: %q", dataset, strings.TrimSpace(string(out)))
+	}
+	return size, nil
+}
+
+// volumeSize returns the size of a zvol in bytes, or -1 if it does not exist.
+func (z *zfs) volumeSize(dataset string) (int64, error) {
+	out, err := z.runner.Run("zfs", "list", "-H", "-p", "-t", "volume", "-o", "name,volsize", "-d", "1", path.Dir(dataset))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != dataset {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse size of zvol %s: %v", dataset, err)
+		}
+		return size, nil
+	}
+	return -1, nil
+}
+
+// destroyVolume destroys a zvol.
+func (z *zfs) destroyVolume(dataset string) error {
+	_, err := z.runner.Run("zfs", "destroy", dataset)
+	return err
+}
+
+// destroyVolumeAndSnapshots destroys a zvol and its snapshots.
+func (z *zfs) destroyVolumeAndSnapshots(dataset string) error {
+	_, err := z.runner.Run("zfs", "destroy", "-r", dataset)
+	return err
+}
+
+// renameVolume renames a zvol.
+func (z *zfs) renameVolume(dataset, newDataset string) error {
+	_, err := z.runner.Run("zfs", "rename", dataset, newDataset)
+	return err
+}
+
+// zfsCopyScript pipes zfs send into zfs receive and fails if either fails:
+// the exit status of zfs send, which sh lacks pipefail to report, is passed
+// out of the pipeline through file descriptor 3.
+const zfsCopyScript = `status=$( { { zfs send %s; echo $? >&3; } | zfs receive %s >&2; } 3>&1 ) || exit; ` +
+	`[ "$status" = 0 ] || { echo "zfs send failed with status $status" >&2; exit 1; }`
+
+// copySnapshot receives a copy of a snapshot as a new zvol. If that fails the
+// zvol may be left partially received.
+func (z *zfs) copySnapshot(snapshot, dataset string) error {
+	_, err := z.runner.Run("sh", "-c", fmt.Sprintf(zfsCopyScript, shellQuote(snapshot), shellQuote(dataset)))
+	return err
+}
+
+// zfsDriver provisions volumes as zvols exported by a target layer.
+type zfsDriver struct {
+	targetExporter
+	zfs *zfs
+}
+
+func newZFSDriver(config ProvisionerConfig) (Driver, error) {
+	target, err := newTargetLayer(config)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newTargetExporter("zfs", target, config)
+	if err != nil {
+		return nil, err
+	}
+	return &zfsDriver{
+		targetExporter: exporter,
+		zfs:            &zfs{runner: execRunner{}},
+	}, nil
+}
+
+func (d *zfsDriver) ValidateParameters(parameters map[string]string) error {
+	if err := checkParameters(parameters, zfsParamParent, zfsParamVolBlockSize, zfsParamCompression, zfsParamSparse); err != nil {
+		return err
+	}
+	if strings.Trim(parameters[zfsParamParent], "/") == "" {
+		return fmt.Errorf("%s must be set in zfs execmode", zfsParamParent)
+	}
+	if blockSize := parameters[zfsParamVolBlockSize]; blockSize != "" {
+		if _, err := parseZFSSize(blockSize); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", zfsParamVolBlockSize, blockSize, err)
+		}
+	}
+	if value := parameters[zfsParamSparse]; value != "" {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", zfsParamSparse, value, err)
+		}
+	}
+	return nil
+}
+
+func (d *zfsDriver) Provision(options VolumeOptions) (*Volume, error) {
+	parent := strings.Trim(options.Parameters[zfsParamParent], "/")
+	if parent == "" {
+		return nil, fmt.Errorf("%s must be set in zfs execmode", zfsParamParent)
+	}
+	name := options.PVName
+	dataset := parent + "/" + name
+
+	size, err := ensureVolume("zvol "+dataset, func() (int64, error) {
+		return d.zfs.volumeSize(dataset)
+	}, func() error {
+		properties := make(map[string]string)
+		if blockSize := options.Parameters[zfsParamVolBlockSize]; blockSize != "" {
+			properties["volblocksize"] = blockSize
+		}
+		if compression := options.Parameters[zfsParamCompression]; compression != "" {
+			properties["compression"] = compression
+		}
+		sparse := false
+		if value := options.Parameters[zfsParamSparse]; value != "" {
+			var err error
+			if sparse, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid %s %q: %v", zfsParamSparse, value, err)
+			}
+		}
+
+		requested, err := d.RoundSize(options.Capacity.Value(), options.Parameters)
+		if err != nil {
+			return err
+		}
+		return d.zfs.createVolume(dataset, requested, sparse, properties)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.export(dataset, size, options, true)
+}
+
+// Clone receives a copy of a snapshot, or of a temporary snapshot of another
+// zvol, as a new zvol. The copy does not depend on its source, which can be
+// deleted independently. Received zvols keep the volblocksize of their source
+// but no other properties and have no reservation, the compression of the
+// class is set on them again.
+func (d *zfsDriver) Clone(options VolumeOptions, source *CloneSource) (*Volume, error) {
+	parent := strings.Trim(options.Parameters[zfsParamParent], "/")
+	if parent == "" {
+		return nil, fmt.Errorf("%s must be set in zfs execmode", zfsParamParent)
+	}
+	name := options.PVName
+	dataset := parent + "/" + name
+
+	// A zvol left by an interrupted clone may be incomplete, start over.
+	size, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		glog.V(3).Infof("destroying zvol %s left by a previous clone", dataset)
+		// The previous clone may have exported it before it failed.
+		if err := d.unexportProvisioned(name, options); err != nil {
+			return nil, err
+		}
+		if err := d.zfs.destroyVolumeAndSnapshots(dataset); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot := source.SnapshotID
+	if snapshot == "" {
+		if !strings.Contains(source.BackendID, "/") {
+			return nil, fmt.Errorf("invalid zfs backend ID %q", source.BackendID)
+		}
+		snapshot = source.BackendID + "@" + name + "-source"
+		if size, _, err := d.zfs.snapshotInfo(snapshot); err != nil {
+			return nil, err
+		} else if size < 0 {
+			if err := d.zfs.createSnapshot(snapshot); err != nil {
+				return nil, err
+			}
+		}
+		defer func() {
+			if err := d.zfs.destroyVolume(snapshot); err != nil {
+				glog.Errorf("error destroying temporary snapshot %s: %v", snapshot, err)
+			}
+		}()
+	}
+	if !strings.Contains(snapshot, "@") {
+		return nil, fmt.Errorf("invalid zfs snapshot ID %q", snapshot)
+	}
+
+	if err := d.zfs.copySnapshot(snapshot, dataset); err != nil {
+		// Don't leave a partial copy behind.
+		if cleanupErr := d.zfs.destroyVolumeAndSnapshots(dataset); cleanupErr != nil {
+			glog.Errorf("error destroying zvol %s: %v", dataset, cleanupErr)
+		}
+		return nil, err
+	}
+	// The received zvol has a copy of the snapshot that is not needed.
+	received := dataset + "@" + strings.SplitN(snapshot, "@", 2)[1]
+	if err := d.zfs.destroyVolume(received); err != nil {
+		glog.Errorf("error destroying received snapshot %s: %v", received, err)
+	}
+	if compression := options.Parameters[zfsParamCompression]; compression != "" {
+		if err := d.zfs.setProperty(dataset, "compression", compression); err != nil {
+			return nil, err
+		}
+	}
+
+	requested, err := d.RoundSize(options.Capacity.Value(), options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if size, err = d.zfs.volumeSize(dataset); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("zvol %s not found after receiving it", dataset)
+	}
+	if size < requested {
+		if err := d.zfs.setVolumeSize(dataset, requested); err != nil {
+			return nil, err
+		}
+		if size, err = d.zfs.volumeSize(dataset); err != nil {
+			return nil, err
+		}
+	}
+	return d.export(dataset, size, options, true)
+}
+
+// export exports a zvol with the given options. If that fails the zvol is
+// destroyed if remove is true.
+func (d *zfsDriver) export(dataset string, size int64, options VolumeOptions, remove bool) (*Volume, error) {
+	e := &export{
+		Name: path.Base(dataset),
+		Path: "/dev/zvol/" + dataset,
+		Size: size,
+	}
+	var destroyVolume func() error
+	if remove {
+		destroyVolume = func() error {
+			return d.zfs.destroyVolume(dataset)
+		}
+	}
+	return d.exportVolume(e, options, dataset, destroyVolume)
+}
+
+// RoundSize rounds size up to a multiple of the volblocksize.
+func (d *zfsDriver) RoundSize(size int64, parameters map[string]string) (int64, error) {
+	granularity := int64(zfsDefaultSizeGranularity)
+	if blockSize := parameters[zfsParamVolBlockSize]; blockSize != "" {
+		var err error
+		if granularity, err = parseZFSSize(blockSize); err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %v", zfsParamVolBlockSize, blockSize, err)
+		}
+	}
+	return roundUp(size, granularity), nil
+}
+
+func (d *zfsDriver) Delete(volume *v1.PersistentVolume) error {
+	if volume.Spec.ISCSI == nil {
+		return fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	size, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return err
+	}
+	// The zvol stays exported until its snapshots are deleted.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(dataset, "deleted"); err != nil {
+			return err
+		}
+	}
+	if err := d.unexportVolume(volume, path.Base(dataset)); err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("zvol %s not found, assuming it is deleted", dataset)
+		return nil
+	}
+	return d.zfs.destroyVolume(dataset)
+}
+
+// checkNoSnapshots returns a permanent error if a zvol has snapshots, which
+// keep it from being deleted, trashed or wiped.
+func (d *zfsDriver) checkNoSnapshots(dataset, operation string) error {
+	snapshots, err := d.zfs.snapshots(dataset)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		return permanentError{fmt.Errorf("zvol %s cannot be %s, it has snapshots: %s. Delete its VolumeSnapshots first", dataset, operation, strings.Join(snapshots, ", "))}
+	}
+	return nil
+}
+
+func (d *zfsDriver) Expand(volume *v1.PersistentVolume, size int64) (int64, error) {
+	if volume.Spec.ISCSI == nil {
+		return 0, fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return 0, fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	current, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return 0, err
+	}
+	if current < 0 {
+		return 0, fmt.Errorf("zvol %s not found", dataset)
+	}
+	e := &export{
+		IQN:  volume.Spec.ISCSI.IQN,
+		Name: path.Base(dataset),
+		Path: "/dev/zvol/" + dataset,
+		Lun:  volume.Spec.ISCSI.Lun,
+	}
+	// Don't grow volumes whose LUN would keep its old size.
+	if err := d.target.CanResize(e); err != nil {
+		return 0, err
+	}
+	if current < size {
+		blockSize, err := d.zfs.blockSize(dataset)
+		if err != nil {
+			return 0, err
+		}
+		if err := d.zfs.setVolumeSize(dataset, roundUp(size, blockSize)); err != nil {
+			return 0, err
+		}
+		if current, err = d.zfs.volumeSize(dataset); err != nil {
+			return 0, err
+		}
+	}
+	e.Size = current
+	return current, d.target.Resize(e)
+}
+
+func (d *zfsDriver) Snapshot(volume *v1.PersistentVolume, name string) (*Snapshot, error) {
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return nil, fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	snapshot := dataset + "@" + name
+	size, created, err := d.zfs.snapshotInfo(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		if err := d.zfs.createSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+		if size, created, err = d.zfs.snapshotInfo(snapshot); err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("snapshot %s not found after creating it", snapshot)
+		}
+	}
+	return &Snapshot{ID: snapshot, SizeBytes: size, CreationTime: created}, nil
+}
+
+func (d *zfsDriver) DeleteSnapshot(id string) error {
+	if !strings.Contains(id, "@") {
+		return fmt.Errorf("invalid zfs snapshot ID %q", id)
+	}
+	size, _, err := d.zfs.snapshotInfo(id)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("snapshot %s not found, assuming it is deleted", id)
+		return nil
+	}
+	return d.zfs.destroyVolume(id)
+}
+
+func (d *zfsDriver) ListSnapshots(volume *v1.PersistentVolume) (map[string]string, error) {
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return nil, fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	snapshots, err := d.zfs.snapshots(dataset)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, snapshot := range snapshots {
+		if i := strings.Index(snapshot, "@"); i >= 0 {
+			ids[snapshot[i+1:]] = snapshot
+		}
+	}
+	return ids, nil
+}
+
+// Trash renames the zvol with a trash- prefix.
+func (d *zfsDriver) Trash(volume *v1.PersistentVolume) (string, error) {
+	if volume.Spec.ISCSI == nil {
+		return "", fmt.Errorf("volume %q is not an iSCSI volume", volume.Name)
+	}
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return "", fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	trashDataset := path.Join(path.Dir(dataset), zfsTrashPrefix+path.Base(dataset))
+	size, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return "", err
+	}
+	// Purging the zvol would destroy the snapshots too.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(dataset, "moved to the trash"); err != nil {
+			return "", err
+		}
+	}
+	if err := d.unexportVolume(volume, path.Base(dataset)); err != nil {
+		return "", err
+	}
+	if size >= 0 {
+		if err := d.zfs.renameVolume(dataset, trashDataset); err != nil {
+			return "", err
+		}
+	} else {
+		glog.V(4).Infof("zvol %s not found, assuming it is in the trash", dataset)
+	}
+	return trashDataset, nil
+}
+
+func (d *zfsDriver) Restore(id string, options VolumeOptions) (*Volume, error) {
+	if !strings.Contains(id, "/") || !strings.HasPrefix(path.Base(id), zfsTrashPrefix) {
+		return nil, fmt.Errorf("zvol %s is not in the trash", id)
+	}
+	parent := strings.Trim(options.Parameters[zfsParamParent], "/")
+	if parent == "" {
+		return nil, fmt.Errorf("%s must be set in zfs execmode", zfsParamParent)
+	}
+	dataset := parent + "/" + options.PVName
+
+	size, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		if size, err = d.zfs.volumeSize(id); err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("zvol %s not found in the trash", id)
+		}
+		if err := d.zfs.renameVolume(id, dataset); err != nil {
+			return nil, err
+		}
+	}
+
+	// Leave the zvol for the next attempt rather than destroy restored
+	// data.
+	return d.export(dataset, size, options, false)
+}
+
+func (d *zfsDriver) Purge(id string) error {
+	if !strings.Contains(id, "/") || !strings.HasPrefix(path.Base(id), zfsTrashPrefix) {
+		return fmt.Errorf("zvol %s is not in the trash", id)
+	}
+	size, err := d.zfs.volumeSize(id)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("zvol %s not found, assuming it is purged", id)
+		return nil
+	}
+	return d.zfs.destroyVolumeAndSnapshots(id)
+}
+
+func (d *zfsDriver) CanWipe(policy string) bool {
+	return policy == wipePolicyDiscard || policy == wipePolicyZeroFill
+}
+
+// Wipe removes the volume from its target, so that no initiator writes to
+// it once it is wiped, and wipes it.
+func (d *zfsDriver) Wipe(volume *v1.PersistentVolume, policy string) error {
+	dataset := getBackendID(volume)
+	if !strings.Contains(dataset, "/") {
+		return fmt.Errorf("invalid zfs backend ID %q", dataset)
+	}
+	size, err := d.zfs.volumeSize(dataset)
+	if err != nil {
+		return err
+	}
+	// Snapshots keep the blocks overwritten by wiping.
+	if size >= 0 {
+		if err := d.checkNoSnapshots(dataset, "wiped"); err != nil {
+			return err
+		}
+	}
+	if err := d.unexportVolume(volume, path.Base(dataset)); err != nil {
+		return err
+	}
+	if size < 0 {
+		glog.V(4).Infof("zvol %s not found, nothing to wipe", dataset)
+		return nil
+	}
+	return wipeDevice(d.zfs.runner, "/dev/zvol/"+dataset, policy)
+}
+
+// parseZFSSize parses a size as accepted by zfs, e.g. "8192", "16K" or "1M".
+func parseZFSSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(size)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = int64(1) << (10 * uint(i+1))
+			break
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return value * multiplier, nil
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// roundUp rounds size up to a multiple of granularity.
+func roundUp(size, granularity int64) int64 {
+	return (size + granularity - 1) / granularity * granularity
+}
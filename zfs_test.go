@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+)
+
+// Prefix of the zfs commands listing the sizes of zvols.
+const testZFSSizes = "zfs list -H -p -t volume"
+
+func newTestZFSDriver(runner *fakeRunner) (*zfsDriver, *fakeTarget) {
+	exporter, target := newTestTargetExporter()
+	return &zfsDriver{targetExporter: exporter, zfs: &zfs{runner: runner}}, target
+}
+
+func TestZFSProvision(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testZFSSizes, "tank/k8s/other\t1073741824\n")
+	runner.respond(testZFSSizes, "tank/k8s/other\t1073741824\ntank/k8s/pvc-1\t1073758208\n")
+	driver, target := newTestZFSDriver(runner)
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30+1, map[string]string{
+		zfsParamParent:       "/tank/k8s/",
+		zfsParamVolBlockSize: "16K",
+		zfsParamCompression:  "lz4",
+		zfsParamSparse:       "true",
+	}))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	// The size is rounded up to the volblocksize.
+	runner.checkCommands(t, "zfs create", "zfs create -s -V 1073758208 -o compression=lz4 -o volblocksize=16K tank/k8s/pvc-1")
+	if e := target.lastExport(t); e.Path != "/dev/zvol/tank/k8s/pvc-1" || e.Name != "pvc-1" {
+		t.Errorf("unexpected export %+v", e)
+	}
+	if volume.BackendID != "tank/k8s/pvc-1" || volume.Size.Value() != 1073758208 {
+		t.Errorf("unexpected volume %+v", volume)
+	}
+}
+
+func TestZFSProvisionDefaults(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respondOnce(testZFSSizes, "")
+	runner.respond(testZFSSizes, "tank/pvc-1\t131072\n")
+	driver, _ := newTestZFSDriver(runner)
+
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1000, map[string]string{zfsParamParent: "tank"})); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	// Not sparse and rounded up to the default granularity.
+	runner.checkCommands(t, "zfs create", "zfs create -V 131072 tank/pvc-1")
+}
+
+func TestZFSProvisionExisting(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "tank/pvc-1\t2147483648\n")
+	driver, _ := newTestZFSDriver(runner)
+
+	volume, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{zfsParamParent: "tank"}))
+	if err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	runner.checkCommands(t, "zfs create")
+	if volume.Size.Value() != 2147483648 {
+		t.Errorf("got size %d, expected the size of the existing zvol", volume.Size.Value())
+	}
+}
+
+func TestZFSProvisionInvalidSparse(t *testing.T) {
+	runner := &fakeRunner{}
+	driver, _ := newTestZFSDriver(runner)
+
+	if _, err := driver.Provision(testVolumeOptions("pvc-1", 1<<30, map[string]string{zfsParamParent: "tank", zfsParamSparse: "maybe"})); err == nil {
+		t.Errorf("Provision succeeded with an invalid %s", zfsParamSparse)
+	}
+	runner.checkCommands(t, "zfs create")
+}
+
+func TestZFSRoundSize(t *testing.T) {
+	driver, _ := newTestZFSDriver(&fakeRunner{})
+
+	tests := []struct {
+		blockSize  string
+		size, want int64
+	}{
+		{size: 1, want: 128 << 10},
+		{size: 1 << 30, want: 1 << 30},
+		{blockSize: "8192", size: 1<<20 + 1, want: 1<<20 + 8192},
+		{blockSize: "16k", size: 1, want: 16 << 10},
+		{blockSize: "1M", size: 1<<20 + 1, want: 2 << 20},
+	}
+	for _, test := range tests {
+		parameters := map[string]string{zfsParamParent: "tank"}
+		if test.blockSize != "" {
+			parameters[zfsParamVolBlockSize] = test.blockSize
+		}
+		size, err := driver.RoundSize(test.size, parameters)
+		if err != nil {
+			t.Errorf("RoundSize of %d with volblocksize %q failed: %v", test.size, test.blockSize, err)
+			continue
+		}
+		if size != test.want {
+			t.Errorf("rounded %d with volblocksize %q to %d, expected %d", test.size, test.blockSize, size, test.want)
+		}
+	}
+
+	for _, blockSize := range []string{"0", "-8K", "16KB", "big"} {
+		if _, err := driver.RoundSize(1<<30, map[string]string{zfsParamParent: "tank", zfsParamVolBlockSize: blockSize}); err == nil {
+			t.Errorf("RoundSize succeeded with volblocksize %q", blockSize)
+		}
+	}
+}
+
+func TestZFSDelete(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "tank/pvc-1\t1073741824\n")
+	driver, target := newTestZFSDriver(runner)
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "tank/pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if len(target.unexported) != 1 || target.unexported[0].Name != "pvc-1" {
+		t.Errorf("got unexports %+v, expected one of pvc-1", target.unexported)
+	}
+	runner.checkCommands(t, "zfs destroy", "zfs destroy tank/pvc-1")
+}
+
+func TestZFSDeleteNotFound(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "tank/other\t1073741824\n")
+	driver, _ := newTestZFSDriver(runner)
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "tank/pvc-1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	runner.checkCommands(t, "zfs destroy")
+}
+
+func TestZFSDeleteWithSnapshots(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "tank/pvc-1\t1073741824\n")
+	runner.respond("zfs list -H -t snapshot -o name -d 1 tank/pvc-1", "tank/pvc-1@snapshot-1234\n")
+	driver, target := newTestZFSDriver(runner)
+
+	err := driver.Delete(testISCSIVolume("pvc-1", "tank/pvc-1"))
+	if err == nil {
+		t.Fatalf("Delete succeeded for a zvol with snapshots")
+	}
+	if isTemporary(err) {
+		t.Errorf("got temporary error %v, expected a permanent one", err)
+	}
+	// The volume stays exported while it is kept.
+	if len(target.unexported) != 0 {
+		t.Errorf("got unexports %+v, expected none", target.unexported)
+	}
+	runner.checkCommands(t, "zfs destroy")
+}
+
+func TestZFSDeleteInvalidBackendID(t *testing.T) {
+	driver, _ := newTestZFSDriver(&fakeRunner{})
+
+	if err := driver.Delete(testISCSIVolume("pvc-1", "pvc-1")); err == nil {
+		t.Errorf("Delete succeeded for an invalid backend ID")
+	}
+}
+
+func TestZFSCloneLeftover(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "tank/pvc-2\t1073741824\n")
+	driver, target := newTestZFSDriver(runner)
+
+	_, err := driver.Clone(testVolumeOptions("pvc-2", 1<<30, map[string]string{zfsParamParent: "tank"}), &CloneSource{SnapshotID: "tank/pvc-1@snapshot-1234"})
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	// The zvol of the previous attempt is unexported before it is destroyed.
+	if len(target.unexported) != 1 || target.unexported[0].IQN != testIQNPrefix+":pvc-2" {
+		t.Errorf("got unexports %+v, expected one of the leftover zvol", target.unexported)
+	}
+	runner.checkCommands(t, "zfs destroy -r", "zfs destroy -r tank/pvc-2")
+}
+
+func TestZFSCloneCopyFailure(t *testing.T) {
+	runner := &fakeRunner{}
+	runner.respond(testZFSSizes, "")
+	runner.fail("sh -c", "zfs send failed with status 1")
+	driver, _ := newTestZFSDriver(runner)
+
+	_, err := driver.Clone(testVolumeOptions("pvc-2", 1<<30, map[string]string{zfsParamParent: "tank"}), &CloneSource{SnapshotID: "tank/pvc-1@snapshot-1234"})
+	if err == nil {
+		t.Fatalf("Clone succeeded although the copy failed")
+	}
+	// The partial copy is destroyed.
+	runner.checkCommands(t, "zfs destroy -r", "zfs destroy -r tank/pvc-2")
+}